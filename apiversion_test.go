@@ -0,0 +1,82 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestReplyFields(t *testing.T) {
+	saved := botAPIVersion
+	t.Cleanup(func() { botAPIVersion = saved })
+
+	tests := []struct {
+		version      string // "" for the current API
+		allowMissing bool
+		want         map[string]string
+	}{
+		{"", false, map[string]string{"reply_parameters": `{"message_id":42}`}},
+		{"", true, map[string]string{"reply_parameters": `{"message_id":42,"allow_sending_without_reply":true}`}},
+		{"7.0", false, map[string]string{"reply_parameters": `{"message_id":42}`}},
+		{"8.1", true, map[string]string{"reply_parameters": `{"message_id":42,"allow_sending_without_reply":true}`}},
+		{"6.9", false, map[string]string{"reply_to_message_id": "42"}},
+		{"6.9", true, map[string]string{"reply_to_message_id": "42", "allow_sending_without_reply": "true"}},
+		{"6", true, map[string]string{"reply_to_message_id": "42", "allow_sending_without_reply": "true"}},
+	}
+	for _, tt := range tests {
+		botAPIVersion = apiVersion{}
+		if tt.version != "" {
+			if err := botAPIVersion.Set(tt.version); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if got := replyFields(42, tt.allowMissing); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("version %q, allowMissing %v: replyFields = %v, want %v", tt.version, tt.allowMissing, got, tt.want)
+		}
+	}
+}
+
+func TestThumbnailField(t *testing.T) {
+	saved := botAPIVersion
+	t.Cleanup(func() { botAPIVersion = saved })
+
+	tests := []struct {
+		version apiVersion
+		want    string
+	}{
+		{apiVersion{}, "thumbnail"},
+		{apiVersion{major: 7}, "thumbnail"},
+		{apiVersion{major: 6, minor: 6}, "thumbnail"},
+		{apiVersion{major: 6, minor: 5}, "thumb"},
+		{apiVersion{major: 5, minor: 7}, "thumb"},
+	}
+	for _, tt := range tests {
+		botAPIVersion = tt.version
+		if got := thumbnailField(); got != tt.want {
+			t.Errorf("version %v: thumbnailField = %q, want %q", &tt.version, got, tt.want)
+		}
+	}
+}
+
+func TestAPIVersionSet(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string // String() of the result; "" for an error
+	}{
+		{"6.5", "6.5"},
+		{"7", "7.0"},
+		{"auto", "auto"},
+		{"0.9", ""},
+		{"x", ""},
+		{"6.x", ""},
+	}
+	for _, tt := range tests {
+		var v apiVersion
+		err := v.Set(tt.in)
+		switch {
+		case tt.want == "" && err == nil:
+			t.Errorf("Set(%q) accepted as %v", tt.in, &v)
+		case tt.want != "" && (err != nil || v.String() != tt.want):
+			t.Errorf("Set(%q) = %v, %v; want %s", tt.in, &v, err, tt.want)
+		}
+	}
+}
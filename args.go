@@ -0,0 +1,86 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+)
+
+// uploadArgs are the named flags replacing the positional arguments.
+type uploadArgs struct {
+	legacy    *bool
+	toSelf    *bool
+	token     *string
+	chat      *string
+	file      *string
+	title     *string
+	performer *string
+	duration  *int
+	replyTo   *int
+	thumbnail *string
+	parseMode *string
+	delay     *int
+}
+
+// uploadArgFlags are the names of the flags in uploadArgs other than
+// -legacy-args and -to-self.
+var uploadArgFlags = []string{"token", "chat", "file", "title", "performer", "duration", "reply-to", "thumbnail", "parse-mode", "delay"}
+
+func addUploadArgFlags() *uploadArgs {
+	return &uploadArgs{
+		legacy:    flag.Bool("legacy-args", false, "DEPRECATED: read the upload from positional arguments in the old order (also assumed when they are given without -token, -chat or -file)"),
+		toSelf:    flag.Bool("to-self", false, "send to the configured owner chat; -chat or the chat_id argument is then omitted"),
+		token:     flag.String("token", "", "bot token"),
+		chat:      flag.String("chat", "", "chat ID or alias to post in"),
+		file:      flag.String("file", "", "file to upload"),
+		title:     flag.String("title", "", "title of the track, or the caption of other files"),
+		performer: flag.String("performer", "", "performer of the track"),
+		duration:  flag.Int("duration", 0, "duration in seconds"),
+		replyTo:   flag.Int("reply-to", 0, "message ID to reply to"),
+		thumbnail: flag.String("thumbnail", "", "thumbnail image (JPEG, at most 320x320)"),
+		parseMode: flag.String("parse-mode", "", "parse mode for the caption: HTML, MarkdownV2 or Markdown"),
+		delay:     flag.Int("delay", 0, "minimum seconds since the last upload before this one starts"),
+	}
+}
+
+// positional returns the upload in the positional argument order the rest
+// of main reads, from the named flags or, in legacy mode, from args. It
+// reports whether the legacy order was used.
+func (a *uploadArgs) positional(args []string, setFlags map[string]bool) ([]string, bool, error) {
+	named := false
+	for _, name := range uploadArgFlags {
+		named = named || setFlags[name]
+	}
+
+	if *a.toSelf && setFlags["chat"] {
+		return nil, false, fmt.Errorf("-to-self and -chat can't be combined")
+	}
+
+	if *a.legacy || !named && len(args) > 0 {
+		if named {
+			return nil, false, fmt.Errorf("-legacy-args and positional arguments can't be combined with -token, -chat, -file and the other upload flags")
+		}
+		// The chat_id argument is left out with -to-self
+		if *a.toSelf && len(args) > 0 {
+			args = append([]string{args[0], "self"}, args[1:]...)
+		}
+		return args, true, nil
+	}
+	if len(args) > 0 {
+		return nil, false, fmt.Errorf("unexpected arguments %q; with -token, -chat and -file, pass the rest as flags too", args)
+	}
+	if *a.toSelf {
+		*a.chat = "self"
+	}
+	if *a.token == "" || *a.chat == "" || *a.file == "" {
+		return nil, false, fmt.Errorf("-token, -chat and -file are required")
+	}
+
+	positional := []string{*a.token, *a.chat, *a.file, *a.title, *a.performer,
+		strconv.Itoa(*a.duration), strconv.Itoa(*a.replyTo), *a.thumbnail, *a.parseMode}
+	// Only a given delay overrides the chat's configured one
+	if setFlags["delay"] {
+		positional = append(positional, strconv.Itoa(*a.delay))
+	}
+	return positional, false, nil
+}
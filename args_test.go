@@ -0,0 +1,64 @@
+package main
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestPositional(t *testing.T) {
+	tests := []struct {
+		name    string
+		set     map[string]string
+		toSelf  bool
+		legacy  bool
+		args    []string
+		want    []string
+		wantErr bool
+	}{
+		{"named", map[string]string{"token": "T", "chat": "5", "file": "a.flac"}, false, false, nil,
+			[]string{"T", "5", "a.flac", "", "", "0", "0", "", ""}, false},
+		{"named with delay", map[string]string{"token": "T", "chat": "5", "file": "a.flac", "delay": "30"}, false, false, nil,
+			[]string{"T", "5", "a.flac", "", "", "0", "0", "", "", "30"}, false},
+		{"legacy implied", nil, false, false, []string{"T", "5", "a.flac"}, []string{"T", "5", "a.flac"}, false},
+		{"legacy to self", nil, true, true, []string{"T", "a.flac"}, []string{"T", "self", "a.flac"}, false},
+		{"named to self", map[string]string{"token": "T", "file": "a.flac"}, true, false, nil,
+			[]string{"T", "self", "a.flac", "", "", "0", "0", "", ""}, false},
+		{"to self and chat", map[string]string{"token": "T", "chat": "5", "file": "a.flac"}, true, false, nil, nil, true},
+		{"named missing file", map[string]string{"token": "T", "chat": "5"}, false, false, nil, nil, true},
+		{"named and positional", map[string]string{"token": "T", "chat": "5", "file": "a.flac"}, false, false, []string{"x"}, nil, true},
+		{"legacy and named", map[string]string{"title": "Song"}, false, true, []string{"T", "5", "a.flac"}, nil, true},
+	}
+	for _, tt := range tests {
+		var token, chat, file, title, performer, thumbnail, parseMode string
+		var duration, replyTo, delay int
+		a := &uploadArgs{legacy: &tt.legacy, toSelf: &tt.toSelf, token: &token, chat: &chat, file: &file,
+			title: &title, performer: &performer, duration: &duration, replyTo: &replyTo,
+			thumbnail: &thumbnail, parseMode: &parseMode, delay: &delay}
+		setFlags := make(map[string]bool)
+		for name, value := range tt.set {
+			setFlags[name] = true
+			switch name {
+			case "token":
+				token = value
+			case "chat":
+				chat = value
+			case "file":
+				file = value
+			case "title":
+				title = value
+			case "delay":
+				delay, _ = strconv.Atoi(value)
+			}
+		}
+
+		got, _, err := a.positional(tt.args, setFlags)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
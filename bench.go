@@ -0,0 +1,161 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// benchRun is the outcome of one benchmark upload.
+type benchRun struct {
+	size     int64
+	duration time.Duration
+	err      error
+}
+
+// percentile returns the p-th percentile of sorted values (nearest rank).
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(p/100*float64(len(sorted))+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i]
+}
+
+// runBench implements the "bench" subcommand: repeated synthetic uploads of
+// several sizes, for tuning a local Bot API server or soak-testing a link.
+// Each test message is deleted again unless -keep is given.
+func runBench(args []string) int {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	addConnectionFlags(fs)
+	sizesFlag := fs.String("sizes", "1M,10M", "comma-separated file sizes to test, e.g. 512K,10M,100M")
+	runs := fs.Int("runs", 5, "uploads per size")
+	concurrency := fs.Int("concurrency", 1, "uploads in flight at once")
+	duration := fs.Duration("duration", 0, "soak test: keep cycling through the sizes for this long instead of -runs")
+	keep := fs.Bool("keep", false, "keep the test messages instead of deleting them")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: uploader bench [flags] <bot_token> <chat_id>\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() < 2 {
+		fs.Usage()
+		return 1
+	}
+	if err := setupTransport(); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid connection settings: %v\n", err)
+		return 1
+	}
+
+	botToken := fs.Arg(0)
+	chatID, err := strconv.ParseInt(fs.Arg(1), 10, 64)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid chat ID: %v\n", err)
+		return 1
+	}
+	var sizes []int64
+	for _, field := range splitList(*sizesFlag) {
+		size, err := parseSize(field)
+		if err != nil || size <= 0 {
+			fmt.Fprintf(os.Stderr, "Invalid -sizes entry %q\n", field)
+			return 1
+		}
+		sizes = append(sizes, size)
+	}
+	if len(sizes) == 0 || *runs < 1 || *concurrency < 1 {
+		fmt.Fprintf(os.Stderr, "-sizes, -runs and -concurrency must not be empty or zero\n")
+		return 1
+	}
+
+	// Hand out sizes to the workers: -runs of each, or round robin until
+	// the soak test is over
+	jobs := make(chan int64)
+	go func() {
+		defer close(jobs)
+		if *duration > 0 {
+			end := time.Now().Add(*duration)
+			for i := 0; time.Now().Before(end); i++ {
+				jobs <- sizes[i%len(sizes)]
+			}
+			return
+		}
+		for _, size := range sizes {
+			for i := 0; i < *runs; i++ {
+				jobs <- size
+			}
+		}
+	}()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	results := make(map[int64][]benchRun)
+	for w := 0; w < *concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for size := range jobs {
+				result, err := speedtestUpload(botToken, chatID, size)
+				run := benchRun{size: size, err: err}
+				if err == nil {
+					run.duration = result.done.Sub(result.start)
+					if !*keep {
+						if _, err := callAPI(botToken, "deleteMessage", url.Values{
+							"chat_id":    {strconv.FormatInt(chatID, 10)},
+							"message_id": {strconv.Itoa(result.messageID)},
+						}); err != nil {
+							logf("Warning: failed to delete test message %d: %v\n", result.messageID, err)
+						}
+					}
+				} else {
+					logf("Upload of %s failed: %v\n", formatSize(size), err)
+				}
+
+				mu.Lock()
+				results[size] = append(results[size], run)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "SIZE\tRUNS\tFAILED\tMIN MiB/s\tMEDIAN\tP90\tMAX\t")
+	failedTotal := 0
+	for _, size := range sizes {
+		var speeds []float64
+		failed := 0
+		for _, run := range results[size] {
+			if run.err != nil {
+				failed++
+				continue
+			}
+			speeds = append(speeds, float64(run.size)/(1<<20)/run.duration.Seconds())
+		}
+		failedTotal += failed
+		sort.Float64s(speeds)
+		if len(speeds) == 0 {
+			fmt.Fprintf(w, "%s\t%d\t%d\t-\t-\t-\t-\t\n", formatSize(size), len(results[size]), failed)
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%.2f\t%.2f\t%.2f\t%.2f\t\n", formatSize(size), len(results[size]), failed,
+			speeds[0], percentile(speeds, 50), percentile(speeds, 90), speeds[len(speeds)-1])
+	}
+	w.Flush()
+
+	if failedTotal > 0 {
+		return 1
+	}
+	return 0
+}
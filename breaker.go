@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const breakerStateName = "breaker.json"
+
+// The circuit breaker is persisted in the state directory so that it also
+// protects against cron jobs or bots that spawn one process per upload: once
+// breakerThreshold consecutive requests have failed, uploads are rejected
+// without contacting Telegram until breakerCooldown has passed. After the
+// cool-down a single request is let through; another failure re-opens it.
+var (
+	breakerThreshold int
+	breakerCooldown  time.Duration
+)
+
+type breakerState struct {
+	ConsecutiveFailures int   `json:"consecutive_failures"`
+	OpenUntil           int64 `json:"open_until"`
+}
+
+func breakerStateFile() string {
+	return filepath.Join(stateDir(), breakerStateName)
+}
+
+func readBreakerState() breakerState {
+	var state breakerState
+	data, err := os.ReadFile(breakerStateFile())
+	if err != nil {
+		return state
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		logf("Ignoring unreadable circuit breaker state in %s: %v\n", breakerStateFile(), err)
+		return breakerState{}
+	}
+	return state
+}
+
+func saveBreakerState(state breakerState) error {
+	data, _ := json.Marshal(state)
+	return writeFileAtomic(breakerStateFile(), data, 0644)
+}
+
+// checkCircuitBreaker returns an error while the breaker is open. Once the
+// cool-down is over, the first caller claims the trial request by holding
+// the breaker open for another cool-down; its result then closes or
+// re-opens it.
+func checkCircuitBreaker() error {
+	if breakerThreshold <= 0 {
+		return nil
+	}
+
+	var openErr error
+	err := withLock(breakerStateFile(), func() error {
+		state := readBreakerState()
+		if openUntil := time.Unix(state.OpenUntil, 0); time.Now().Before(openUntil) {
+			openErr = fmt.Errorf("circuit breaker open after %d consecutive failures, not retrying until %s",
+				state.ConsecutiveFailures, openUntil.Format(time.RFC3339))
+			return nil
+		}
+		if state.ConsecutiveFailures < breakerThreshold {
+			return nil
+		}
+		state.OpenUntil = time.Now().Add(breakerCooldown).Unix()
+		return saveBreakerState(state)
+	})
+	if err != nil {
+		logf("Failed to update circuit breaker state: %v\n", err)
+	}
+	return openErr
+}
+
+// recordBreakerResult updates the breaker after a request. Failures specific
+// to one file (bad request, file too large) say nothing about the health of
+// the token or the API and are not counted. The update holds the breaker's
+// lock, so concurrent uploaders don't lose each other's failures.
+func recordBreakerResult(err error) {
+	if breakerThreshold <= 0 || err != nil && isFileSpecificError(err) {
+		return
+	}
+
+	lockErr := withLock(breakerStateFile(), func() error {
+		state := readBreakerState()
+		if err == nil {
+			if state.ConsecutiveFailures == 0 {
+				return nil
+			}
+			return saveBreakerState(breakerState{})
+		}
+		state.ConsecutiveFailures++
+		if state.ConsecutiveFailures >= breakerThreshold {
+			state.OpenUntil = time.Now().Add(breakerCooldown).Unix()
+			logf("Circuit breaker opened for %v after %d consecutive failures\n", breakerCooldown, state.ConsecutiveFailures)
+		}
+		return saveBreakerState(state)
+	})
+	if lockErr != nil {
+		logf("Failed to save circuit breaker state: %v\n", lockErr)
+	}
+}
+
+func isFileSpecificError(err error) bool {
+	if isTooLarge(err) {
+		return true
+	}
+	var apiErr *TelegramError
+	return errors.As(err, &apiErr) && apiErr.IsBadRequest()
+}
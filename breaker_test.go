@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	t.Setenv(stateDirEnv, t.TempDir())
+	breakerThreshold, breakerCooldown = 3, time.Hour
+	t.Cleanup(func() { breakerThreshold, breakerCooldown = 0, 0 })
+
+	failure := &retryableError{err: errors.New("HTTP 502"), status: 502}
+	badFile := &TelegramError{Code: 400, Description: "Bad Request: wrong file"}
+	expire := func() {
+		state := readBreakerState()
+		state.OpenUntil = time.Now().Add(-time.Second).Unix()
+		saveBreakerState(state)
+	}
+	steps := []struct {
+		name     string
+		do       func()
+		open     bool
+		failures int
+	}{
+		{"closed at start", func() {}, false, 0},
+		{"failure below threshold", func() { recordBreakerResult(failure) }, false, 1},
+		{"file errors don't count", func() { recordBreakerResult(badFile) }, false, 1},
+		{"success resets", func() { recordBreakerResult(nil) }, false, 0},
+		{"threshold opens", func() {
+			for i := 0; i < 3; i++ {
+				recordBreakerResult(failure)
+			}
+		}, true, 3},
+		{"cool-down over lets a trial through", expire, false, 3},
+		{"trial holds it open for the rest", func() {}, true, 3},
+		{"failed trial re-opens", func() { expire(); checkCircuitBreaker(); recordBreakerResult(failure) }, true, 4},
+		{"successful trial closes", func() { expire(); checkCircuitBreaker(); recordBreakerResult(nil) }, false, 0},
+	}
+	for _, step := range steps {
+		step.do()
+		err := checkCircuitBreaker()
+		if open := err != nil; open != step.open {
+			t.Fatalf("%s: open = %v (%v), want %v", step.name, open, err, step.open)
+		}
+		if err != nil && !strings.Contains(err.Error(), "circuit breaker open") {
+			t.Errorf("%s: unexpected error %v", step.name, err)
+		}
+		if got := readBreakerState().ConsecutiveFailures; got != step.failures {
+			t.Errorf("%s: %d consecutive failures, want %d", step.name, got, step.failures)
+		}
+	}
+}
+
+func TestCircuitBreakerDisabled(t *testing.T) {
+	t.Setenv(stateDirEnv, t.TempDir())
+	breakerThreshold = 0
+	for i := 0; i < 10; i++ {
+		recordBreakerResult(errors.New("down"))
+	}
+	if err := checkCircuitBreaker(); err != nil {
+		t.Errorf("a disabled breaker opened: %v", err)
+	}
+}
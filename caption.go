@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+	"unicode/utf16"
+)
+
+const (
+	// Telegram measures text limits in UTF-16 code units
+	captionLimit = 1024
+	messageLimit = 4096
+)
+
+// Caption overflow modes
+const (
+	overflowTruncate = "truncate" // cut the caption and end it with an ellipsis
+	overflowFollowUp = "followup" // send the rest as replies to the media
+	overflowError    = "error"    // send as-is and let the API reject it
+)
+
+func utf16Len(s string) int {
+	return len(utf16.Encode([]rune(s)))
+}
+
+// splitUnits returns where to cut text so the head holds at most limit
+// UTF-16 code units, preferring to break at a newline or space in the
+// second half of it and never inside a surrogate pair.
+func splitUnits(units []uint16, limit int) int {
+	if len(units) <= limit {
+		return len(units)
+	}
+	cut := limit
+	if utf16.IsSurrogate(rune(units[cut-1])) && units[cut-1] < 0xdc00 {
+		cut--
+	}
+	for i := cut - 1; i > cut/2; i-- {
+		if units[i] == '\n' || units[i] == ' ' {
+			return i
+		}
+	}
+	return cut
+}
+
+// skipSpace returns the position of the first unit from start on that is
+// not a newline or space.
+func skipSpace(units []uint16, start int) int {
+	for start < len(units) && (units[start] == '\n' || units[start] == ' ') {
+		start++
+	}
+	return start
+}
+
+// splitText cuts s into a head of at most limit UTF-16 code units and the
+// remainder, preferring to break at a newline or space.
+func splitText(s string, limit int) (string, string) {
+	units := utf16.Encode([]rune(s))
+	cut := splitUnits(units, limit)
+	return string(utf16.Decode(units[:cut])), string(utf16.Decode(units[skipSpace(units, cut):]))
+}
+
+// fitCaption applies the overflow mode to a caption that may exceed
+// Telegram's limit. It returns the caption to send and any follow-up
+// messages to post after it. With a parse mode the limit applies to the
+// text as displayed, so the markup is parsed, cut there and written again
+// with entities closed at the end of each part and reopened in the next.
+func fitCaption(caption, mode, parseMode string) (string, []string, error) {
+	text, entities, err := parseEntities(caption, parseMode)
+	if err != nil {
+		if utf16Len(caption) <= captionLimit || mode == overflowError {
+			return caption, nil, nil
+		}
+		return "", nil, fmt.Errorf("caption is over %d characters, and its %s markup can't be cut safely: %v", captionLimit, parseMode, err)
+	}
+	units := utf16.Encode([]rune(text))
+	if len(units) <= captionLimit {
+		return caption, nil, nil
+	}
+
+	part := func(start, end int) string {
+		return renderEntities(units[start:end], clipEntities(entities, start, end), parseMode)
+	}
+	switch mode {
+	case overflowTruncate, "":
+		end := splitUnits(units, captionLimit-1)
+		for end > 0 && (units[end-1] == '\n' || units[end-1] == ' ') {
+			end--
+		}
+		return part(0, end) + "…", nil, nil
+	case overflowFollowUp:
+		end := splitUnits(units, captionLimit)
+		head := part(0, end)
+		var followUps []string
+		for start := skipSpace(units, end); start < len(units); start = skipSpace(units, end) {
+			end = start + splitUnits(units[start:], messageLimit)
+			followUps = append(followUps, part(start, end))
+		}
+		return head, followUps, nil
+	case overflowError:
+		return caption, nil, nil
+	default:
+		return "", nil, fmt.Errorf("unknown caption overflow mode %q", mode)
+	}
+}
+
+// sendFollowUps posts the caption remainder as a chain of text messages,
+// each replying to the previous one starting from the uploaded media.
+func sendFollowUps(opts uploadOptions, replyTo int, texts []string) error {
+	for _, text := range texts {
+		params := url.Values{
+			"chat_id": {strconv.FormatInt(opts.ChatID, 10)},
+			"text":    {text},
+		}
+		for key, value := range replyFields(replyTo, false) {
+			params.Set(key, value)
+		}
+		if opts.ParseMode != "" {
+			params.Set("parse_mode", opts.ParseMode)
+		}
+
+		raw, err := callAPI(opts.BotToken, "sendMessage", params)
+		if err != nil {
+			return fmt.Errorf("failed to send caption follow-up: %v", err)
+		}
+
+		var message struct {
+			MessageID int `json:"message_id"`
+		}
+		if err := json.Unmarshal(raw, &message); err == nil && message.MessageID != 0 {
+			replyTo = message.MessageID
+		}
+	}
+	return nil
+}
+
+// captionData is what a -caption template can refer to.
+type captionData struct {
+	Title     string
+	Performer string
+	Duration  int
+	FileName  string
+	Ext       string
+	Size      int64
+	SizeHuman string
+}
+
+// renderCaption executes a text/template caption for the file in opts.
+func renderCaption(text string, opts uploadOptions) (string, error) {
+	tmpl, err := template.New("caption").Funcs(template.FuncMap{
+		"humanSize":     humanSize,
+		"humanDuration": humanDuration,
+	}).Parse(text)
+	if err != nil {
+		return "", err
+	}
+
+	data := captionData{
+		Title:     opts.Title,
+		Performer: opts.Performer,
+		Duration:  opts.Duration,
+		FileName:  uploadFilename(opts),
+		Ext:       strings.TrimPrefix(filepath.Ext(opts.FilePath), "."),
+	}
+	if info, err := os.Stat(opts.FilePath); err == nil {
+		data.Size = info.Size()
+		data.SizeHuman, _ = humanSize(info.Size())
+	}
+
+	var b strings.Builder
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(b.String()), nil
+}
+
+// numberLocale is how sizes are written in one language.
+type numberLocale struct {
+	decimal string
+	units   [5]string
+}
+
+var numberLocales = map[string]numberLocale{
+	"en": {".", [5]string{"B", "KB", "MB", "GB", "TB"}},
+	"de": {",", [5]string{"B", "KB", "MB", "GB", "TB"}},
+	"es": {",", [5]string{"B", "KB", "MB", "GB", "TB"}},
+	"it": {",", [5]string{"B", "KB", "MB", "GB", "TB"}},
+	"nl": {",", [5]string{"B", "KB", "MB", "GB", "TB"}},
+	"pt": {",", [5]string{"B", "KB", "MB", "GB", "TB"}},
+	"fr": {",", [5]string{"o", "Ko", "Mo", "Go", "To"}},
+	"ru": {",", [5]string{"Б", "КБ", "МБ", "ГБ", "ТБ"}},
+	"uk": {",", [5]string{"Б", "КБ", "МБ", "ГБ", "ТБ"}},
+}
+
+// captionLocale is the default locale for humanSize in caption templates.
+var captionLocale = "en"
+
+// humanSize renders a byte count the way Telegram clients do, in 1024
+// steps with one decimal, e.g. "7.2 MB". An optional locale overrides
+// captionLocale.
+func humanSize(n int64, locale ...string) (string, error) {
+	name := captionLocale
+	if len(locale) > 0 {
+		name = locale[0]
+	}
+	loc, ok := numberLocales[name]
+	if !ok {
+		return "", fmt.Errorf("unknown locale %q", name)
+	}
+
+	value, unit := float64(n), 0
+	for value >= 1024 && unit < len(loc.units)-1 {
+		value /= 1024
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%d %s", n, loc.units[0]), nil
+	}
+	text := strconv.FormatFloat(value, 'f', 1, 64)
+	return strings.Replace(text, ".", loc.decimal, 1) + " " + loc.units[unit], nil
+}
+
+// humanDuration renders seconds as m:ss, or h:mm:ss from an hour up.
+func humanDuration(seconds int) string {
+	if seconds < 0 {
+		seconds = 0
+	}
+	h, m, sec := seconds/3600, seconds/60%60, seconds%60
+	if h > 0 {
+		return fmt.Sprintf("%d:%02d:%02d", h, m, sec)
+	}
+	return fmt.Sprintf("%d:%02d", m, sec)
+}
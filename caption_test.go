@@ -0,0 +1,139 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRenderEntitiesRoundTrip(t *testing.T) {
+	tests := []struct {
+		parseMode string
+		markup    string
+	}{
+		{"HTML", `<b>bold <i>both</i></b> &lt;tag&gt; &amp; <a href="https://x.y/?a=1&amp;b=2">link</a>`},
+		{"HTML", `<pre><code class="language-go">x := "&lt;1&gt;"</code></pre><tg-spoiler>hidden</tg-spoiler>`},
+		{"HTML", `<blockquote expandable>quoted</blockquote> <u>under</u> <s>struck</s> <code>c</code>`},
+		{"MarkdownV2", `*bold _both_* \. \(x\) ||spoiler|| ~struck~ [link](https://x.y/\)z)`},
+		{"MarkdownV2", "`a\\`b` ```go\nx := 1``` __under__ 😀 *bold*"},
+		{"MarkdownV2", "___italic underline_\r__ plain"},
+		{"MarkdownV2", ">line one\n>line two\nafter"},
+		{"MarkdownV2", "**>hidden\n>more||\nafter"},
+		{"Markdown", "*bold* _italic_ `code` [link](http://x.y) \\_plain\\_"},
+		{"Markdown", "```py\nx = 1```"},
+	}
+	for _, tt := range tests {
+		text, entities, err := parseEntities(tt.markup, tt.parseMode)
+		if err != nil {
+			t.Errorf("%s %q: %v", tt.parseMode, tt.markup, err)
+			continue
+		}
+		markup := renderEntities(utf16Units(text), entities, tt.parseMode)
+		text2, entities2, err := parseEntities(markup, tt.parseMode)
+		if err != nil {
+			t.Errorf("%s %q rendered as %q, which does not parse: %v", tt.parseMode, tt.markup, markup, err)
+			continue
+		}
+		if text2 != text || !reflect.DeepEqual(entities2, entities) {
+			t.Errorf("%s %q: rendered as %q, which parses to %q %+v, want %q %+v",
+				tt.parseMode, tt.markup, markup, text2, entities2, text, entities)
+		}
+	}
+}
+
+func TestFitCaptionMarkup(t *testing.T) {
+	words := strings.Repeat("word ", 300)
+	tests := []struct {
+		name      string
+		parseMode string
+		caption   string
+		mode      string
+		parts     int
+	}{
+		{"plain truncate", "", words, overflowTruncate, 1},
+		{"plain followup", "", words, overflowFollowUp, 2},
+		{"html fits once parsed", "HTML", strings.Repeat("<b>w</b>", 300), overflowTruncate, 1},
+		{"html truncate in tag", "HTML", "<b>" + words + "</b>", overflowTruncate, 1},
+		{"html followup in tag", "HTML", "<i>x <b>" + words + "</b></i>", overflowFollowUp, 2},
+		{"html entity escapes", "HTML", "<b>" + strings.Repeat("&amp;&lt; ", 400) + "</b>", overflowFollowUp, 2},
+		{"markdownv2 truncate in bold", "MarkdownV2", "*" + words + "*", overflowTruncate, 1},
+		{"markdownv2 escapes", "MarkdownV2", "_" + strings.Repeat("a\\. ", 400) + "_", overflowFollowUp, 2},
+		{"markdownv2 quote", "MarkdownV2", ">" + strings.Repeat("line\n>", 300) + "end", overflowFollowUp, 2},
+		{"markdown followup in bold", "Markdown", "*" + words + "*", overflowFollowUp, 2},
+		{"error mode sends as is", "HTML", "<b>" + words + "</b>", overflowError, 1},
+	}
+	for _, tt := range tests {
+		head, followUps, err := fitCaption(tt.caption, tt.mode, tt.parseMode)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		parts := append([]string{head}, followUps...)
+		if len(parts) != tt.parts {
+			t.Errorf("%s: got %d part(s), want %d", tt.name, len(parts), tt.parts)
+		}
+		if tt.mode == overflowError {
+			if head != tt.caption {
+				t.Errorf("%s: caption changed", tt.name)
+			}
+			continue
+		}
+
+		want, wantEntities, _ := parseEntities(tt.caption, tt.parseMode)
+		var got strings.Builder
+		for i, part := range parts {
+			text, entities, err := parseEntities(part, tt.parseMode)
+			if err != nil {
+				t.Errorf("%s: part %d does not parse: %v\n%q", tt.name, i, err, part)
+				continue
+			}
+			limit := messageLimit
+			if i == 0 {
+				limit = captionLimit
+			}
+			if n := utf16Len(text); n > limit {
+				t.Errorf("%s: part %d is %d characters, over %d", tt.name, i, n, limit)
+			}
+			if len(wantEntities) > 0 && len(entities) == 0 {
+				t.Errorf("%s: part %d lost its formatting: %q", tt.name, i, part)
+			}
+			got.WriteString(strings.TrimSuffix(text, "…") + " ")
+		}
+		// Parts only drop the whitespace they were cut at
+		if tt.mode == overflowFollowUp && strings.Join(strings.Fields(got.String()), " ") != strings.Join(strings.Fields(want), " ") {
+			t.Errorf("%s: the parts don't add up to the caption", tt.name)
+		}
+	}
+}
+
+func TestFitCaptionUnparsableMarkup(t *testing.T) {
+	long := "<b>" + strings.Repeat("word ", 300)
+	if _, _, err := fitCaption(long, overflowTruncate, "HTML"); err == nil {
+		t.Errorf("an over-long caption with broken markup was cut")
+	}
+	short := "<b>word"
+	if head, _, err := fitCaption(short, overflowTruncate, "HTML"); err != nil || head != short {
+		t.Errorf("a short caption was not left to Telegram: %q, %v", head, err)
+	}
+}
+
+func TestSplitText(t *testing.T) {
+	tests := []struct {
+		s     string
+		limit int
+		head  string
+		rest  string
+	}{
+		{"short", 10, "short", ""},
+		{"hello world again", 13, "hello world", "again"},
+		{"abcdefghij", 4, "abcd", "efghij"},
+		{"ab😀cd", 3, "ab", "😀cd"},
+		{"line one\nline two", 12, "line one", "line two"},
+	}
+	for _, tt := range tests {
+		head, rest := splitText(tt.s, tt.limit)
+		if head != tt.head || rest != tt.rest {
+			t.Errorf("splitText(%q, %d) = %q, %q; want %q, %q", tt.s, tt.limit, head, rest, tt.head, tt.rest)
+		}
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+const configEnv = "UPLOADER_CONFIG"
+
+// configMu serialises read-modify-write updates from concurrent sends.
+var configMu sync.Mutex
+
+// config holds settings that are set once and outlive a single run, unlike
+// the state directory which only holds what the uploader records itself.
+type config struct {
+	// OwnerChatID is the chat "self" and -to-self resolve to
+	OwnerChatID int64 `json:"owner_chat_id,omitempty"`
+
+	// Aliases are names usable wherever a chat ID is expected
+	Aliases map[string]int64 `json:"aliases,omitempty"`
+
+	// Headers are added to every Bot API request, before any -header flags
+	Headers map[string]string `json:"headers,omitempty"`
+
+	// Limits cap requests per bot, keyed by the bot ID (the part of the
+	// token before the colon), in place of -max-concurrent and -max-rps
+	Limits map[string]tokenLimits `json:"limits,omitempty"`
+
+	// Chats holds per-chat defaults, keyed by chat ID or alias
+	Chats map[string]chatDefaults `json:"chats,omitempty"`
+}
+
+// chatDefaults are a chat's posting conventions, applied when uploading to
+// it unless the matching flag or argument is given.
+type chatDefaults struct {
+	ParseMode      string `json:"parse_mode,omitempty"`
+	DelaySeconds   int    `json:"delay_seconds,omitempty"`
+	Caption        string `json:"caption,omitempty"`
+	ProtectContent bool   `json:"protect_content,omitempty"`
+	Topic          string `json:"topic,omitempty"`
+}
+
+// configFile returns $UPLOADER_CONFIG, or config.json in the user's config
+// directory.
+func configFile() string {
+	if path := os.Getenv(configEnv); path != "" {
+		return path
+	}
+	if dir, err := os.UserConfigDir(); err == nil {
+		return filepath.Join(dir, "uploader", "config.json")
+	}
+	return filepath.Join(stateDir(), "config.json")
+}
+
+// loadConfig reads the config file. A missing file is an empty config.
+func loadConfig() (*config, error) {
+	cfg := &config{}
+	data, err := os.ReadFile(configFile())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return cfg, nil
+		}
+		return nil, fmt.Errorf("failed to read config: %v", err)
+	}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse config %s: %v", configFile(), err)
+	}
+	return cfg, nil
+}
+
+func saveConfig(cfg *config) error {
+	data, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(configFile()), 0755); err != nil {
+		return fmt.Errorf("failed to create directory: %v", err)
+	}
+	return writeFileAtomic(configFile(), append(data, '\n'), 0600)
+}
+
+// resolveChatID parses a chat argument, accepting "self" for the configured
+// owner chat and alias names.
+func resolveChatID(cfg *config, value string) (int64, error) {
+	if value == "self" {
+		if cfg.OwnerChatID == 0 {
+			return 0, fmt.Errorf("no owner chat configured; run: uploader config set-owner <chat_id>")
+		}
+		return cfg.OwnerChatID, nil
+	}
+	if chatID, ok := cfg.Aliases[value]; ok {
+		return chatID, nil
+	}
+	return strconv.ParseInt(value, 10, 64)
+}
+
+// defaultsFor returns the defaults configured for chatID, under its ID or
+// any alias for it. An entry under the ID wins over one under an alias.
+func (cfg *config) defaultsFor(chatID int64) chatDefaults {
+	if defaults, ok := cfg.Chats[strconv.FormatInt(chatID, 10)]; ok {
+		return defaults
+	}
+	names := make([]string, 0, len(cfg.Aliases))
+	for name, aliasID := range cfg.Aliases {
+		if aliasID == chatID {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if defaults, ok := cfg.Chats[name]; ok {
+			return defaults
+		}
+	}
+	return chatDefaults{}
+}
+
+// migratedChat returns the supergroup ID from a "group chat was upgraded"
+// error, or 0 for any other error.
+func migratedChat(err error) int64 {
+	var apiErr *TelegramError
+	if errors.As(err, &apiErr) {
+		return apiErr.Parameters.MigrateToChatID
+	}
+	return 0
+}
+
+// updateMigratedChat points the owner chat and any aliases still naming
+// oldID at newID, so later runs go straight to the supergroup.
+func updateMigratedChat(oldID, newID int64) error {
+	configMu.Lock()
+	defer configMu.Unlock()
+
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	changed := false
+	if cfg.OwnerChatID == oldID {
+		cfg.OwnerChatID = newID
+		changed = true
+	}
+	for name, chatID := range cfg.Aliases {
+		if chatID == oldID {
+			cfg.Aliases[name] = newID
+			changed = true
+		}
+	}
+	// Defaults keyed by the old ID follow the chat, unless the new ID
+	// already has its own
+	oldKey, newKey := strconv.FormatInt(oldID, 10), strconv.FormatInt(newID, 10)
+	if defaults, ok := cfg.Chats[oldKey]; ok {
+		if _, exists := cfg.Chats[newKey]; !exists {
+			cfg.Chats[newKey] = defaults
+		}
+		delete(cfg.Chats, oldKey)
+		changed = true
+	}
+	if !changed {
+		return nil
+	}
+	return saveConfig(cfg)
+}
+
+// runConfig implements the "config" subcommand.
+func runConfig(args []string) int {
+	if len(args) < 1 {
+		fmt.Fprintf(os.Stderr, "Usage: uploader config show\n")
+		fmt.Fprintf(os.Stderr, "       uploader config set-owner <chat_id>\n")
+		fmt.Fprintf(os.Stderr, "       uploader config alias <name> [chat_id]\n")
+		fmt.Fprintf(os.Stderr, "       uploader config topic <chat_id> <name> <thread_id>\n")
+		fmt.Fprintf(os.Stderr, "       uploader config validate\n")
+		return 1
+	}
+
+	// Validation reports a config that doesn't load instead of failing on it
+	if args[0] == "validate" {
+		problems := validateConfig()
+		for _, problem := range problems {
+			fmt.Fprintf(os.Stderr, "  - %s\n", problem)
+		}
+		if len(problems) > 0 {
+			fmt.Fprintf(os.Stderr, "%d problem(s) found\n", len(problems))
+			return 1
+		}
+		fmt.Printf("Config %s and state directory %s are valid\n", configFile(), stateDir())
+		return 0
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+
+	switch args[0] {
+	case "show":
+		data, err := json.MarshalIndent(cfg, "", "  ")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return 1
+		}
+		fmt.Printf("# %s\n%s\n", configFile(), data)
+
+	case "set-owner":
+		if len(args) < 2 {
+			fmt.Fprintf(os.Stderr, "Usage: uploader config set-owner <chat_id>\n")
+			return 1
+		}
+		chatID, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid chat ID: %v\n", err)
+			return 1
+		}
+		cfg.OwnerChatID = chatID
+		if err := saveConfig(cfg); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to save config: %v\n", err)
+			return 1
+		}
+
+	case "alias":
+		if len(args) < 2 {
+			fmt.Fprintf(os.Stderr, "Usage: uploader config alias <name> [chat_id]\n")
+			return 1
+		}
+		name := args[1]
+		if _, err := strconv.ParseInt(name, 10, 64); err == nil || name == "self" {
+			fmt.Fprintf(os.Stderr, "Alias %q would shadow a chat ID\n", name)
+			return 1
+		}
+		if len(args) < 3 {
+			// Without a chat ID, remove the alias
+			delete(cfg.Aliases, name)
+		} else {
+			chatID, err := strconv.ParseInt(args[2], 10, 64)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Invalid chat ID: %v\n", err)
+				return 1
+			}
+			if cfg.Aliases == nil {
+				cfg.Aliases = make(map[string]int64)
+			}
+			cfg.Aliases[name] = chatID
+		}
+		if err := saveConfig(cfg); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to save config: %v\n", err)
+			return 1
+		}
+
+	case "topic":
+		// Topics live in the state directory's cache, next to the ones
+		// -create-topic made
+		if len(args) < 4 {
+			fmt.Fprintf(os.Stderr, "Usage: uploader config topic <chat_id> <name> <thread_id>\n")
+			return 1
+		}
+		chatID, err := resolveChatID(cfg, args[1])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid chat ID: %v\n", err)
+			return 1
+		}
+		threadID, err := strconv.Atoi(args[3])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid thread ID: %v\n", err)
+			return 1
+		}
+		if err := rememberTopic(chatID, args[2], threadID); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to save topic: %v\n", err)
+			return 1
+		}
+
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown config action %q\n", args[0])
+		return 1
+	}
+
+	return 0
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const deadLetterFileName = "deadletter.jsonl"
+
+// deadLetter is an upload that failed for good, kept so it can be inspected
+// and retried later. The bot token is deliberately not stored.
+type deadLetter struct {
+	Time     time.Time     `json:"time"`
+	Attempts int           `json:"attempts"`
+	Error    string        `json:"error"`
+	Job      uploadOptions `json:"job"`
+}
+
+func deadLetterFile() string {
+	return filepath.Join(stateDir(), deadLetterFileName)
+}
+
+func appendDeadLetter(job uploadOptions, attempts int, uploadErr error) error {
+	if err := os.MkdirAll(stateDir(), 0755); err != nil {
+		return fmt.Errorf("failed to create directory: %v", err)
+	}
+
+	line, err := json.Marshal(deadLetter{
+		Time:     time.Now().UTC(),
+		Attempts: attempts,
+		Error:    uploadErr.Error(),
+		Job:      job,
+	})
+	if err != nil {
+		return err
+	}
+
+	return withLock(deadLetterFile(), func() error {
+		return appendLine(deadLetterFile(), line)
+	})
+}
+
+// readDeadLetters returns the dead-letter list, skipping unreadable lines.
+func readDeadLetters() ([]deadLetter, error) {
+	file, err := os.Open(deadLetterFile())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read dead letters: %v", err)
+	}
+	defer file.Close()
+
+	var letters []deadLetter
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var letter deadLetter
+		if err := json.Unmarshal(scanner.Bytes(), &letter); err != nil {
+			continue
+		}
+		letters = append(letters, letter)
+	}
+	return letters, scanner.Err()
+}
+
+func writeDeadLetters(letters []deadLetter) error {
+	var buf strings.Builder
+	for _, letter := range letters {
+		line, err := json.Marshal(letter)
+		if err != nil {
+			return err
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	return writeFileAtomic(deadLetterFile(), []byte(buf.String()), 0644)
+}
+
+// settleDeadLetter updates the list once letter has been retried as job,
+// starting at started. The letter goes; if the retry failed, the job stays
+// listed with its new error, once, whether or not uploadFile listed it
+// again itself. Letters added meanwhile by other runs are kept.
+func settleDeadLetter(letter deadLetter, job uploadOptions, started time.Time, retryErr error) error {
+	original, _ := json.Marshal(letter)
+	retried, _ := json.Marshal(job)
+	return withLock(deadLetterFile(), func() error {
+		letters, err := readDeadLetters()
+		if err != nil {
+			return err
+		}
+		kept := letters[:0:0]
+		removed, relisted := false, false
+		for _, l := range letters {
+			if line, _ := json.Marshal(l); !removed && string(line) == string(original) {
+				removed = true
+				continue
+			}
+			if line, _ := json.Marshal(l.Job); string(line) == string(retried) && !l.Time.Before(started) {
+				relisted = true
+			}
+			kept = append(kept, l)
+		}
+		if retryErr != nil && !relisted {
+			kept = append(kept, deadLetter{Time: time.Now().UTC(), Attempts: 1, Error: retryErr.Error(), Job: letter.Job})
+		}
+		return writeDeadLetters(kept)
+	})
+}
+
+// runDeadLetter implements the "deadletter" subcommand.
+func runDeadLetter(args []string) int {
+	if len(args) < 1 {
+		fmt.Fprintf(os.Stderr, "Usage: uploader deadletter list\n")
+		fmt.Fprintf(os.Stderr, "       uploader deadletter retry [connection flags] <bot_token>\n")
+		fmt.Fprintf(os.Stderr, "       uploader deadletter notify [connection flags] <bot_token> <chat_id>\n")
+		fmt.Fprintf(os.Stderr, "       uploader deadletter clear\n")
+		return 1
+	}
+
+	action := args[0]
+	fs := flag.NewFlagSet("deadletter "+action, flag.ExitOnError)
+	addConnectionFlags(fs)
+	fs.Parse(args[1:])
+	if err := setupTransport(); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid connection settings: %v\n", err)
+		return 1
+	}
+	args = append([]string{action}, fs.Args()...)
+
+	letters, err := readDeadLetters()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+
+	switch action {
+	case "list":
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "TIME\tCHAT\tATTEMPTS\tFILE\tERROR")
+		for _, letter := range letters {
+			fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%s\n", letter.Time.Local().Format("2006-01-02 15:04:05"),
+				letter.Job.ChatID, letter.Attempts, letter.Job.FilePath, letter.Error)
+		}
+		w.Flush()
+
+	case "retry":
+		if len(args) < 2 {
+			fmt.Fprintf(os.Stderr, "Usage: uploader deadletter retry <bot_token>\n")
+			return 1
+		}
+
+		if err := detectAPIVersion(args[1]); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return 1
+		}
+
+		// Each letter stays listed until its retry is over, so an
+		// interrupted run loses nothing
+		failed := 0
+		for _, letter := range letters {
+			job := letter.Job
+			job.BotToken = args[1]
+			job.DelaySeconds = 0
+			started := time.Now()
+
+			// A job that posted before the list was updated is done
+			var existing *historyEntry
+			if job.JobID != "" {
+				if existing, err = findJob(job.JobID); err != nil {
+					fmt.Fprintf(os.Stderr, "%v\n", err)
+					return 1
+				}
+			}
+
+			messageID := 0
+			if existing != nil && existing.Staged && job.PublishChatID != 0 {
+				// Staged before but not published: publish that copy
+				messageID, err = publishStaged(job, stagedUpload(existing))
+			} else if existing != nil {
+				messageID = existing.MessageID
+			} else {
+				var result *uploadResult
+				result, err = uploadFile(job)
+				if err == nil {
+					messageID = result.MessageID
+					// A staged job goes on to its public chat
+					if job.PublishChatID != 0 {
+						messageID, err = publishStaged(job, result)
+					}
+				}
+			}
+			if settleErr := settleDeadLetter(letter, job, started, err); settleErr != nil {
+				logf("Warning: failed to update dead letters: %v\n", settleErr)
+			}
+			if err != nil {
+				logf("Retry of %s failed: %v\n", job.FilePath, err)
+				failed++
+				continue
+			}
+			fmt.Printf("%s\t%d\n", job.FilePath, messageID)
+		}
+		if failed > 0 {
+			return 1
+		}
+
+	case "notify":
+		if len(args) < 3 {
+			fmt.Fprintf(os.Stderr, "Usage: uploader deadletter notify <bot_token> <chat_id>\n")
+			return 1
+		}
+		if len(letters) == 0 {
+			return 0
+		}
+		if _, err := callAPI(args[1], "sendMessage", url.Values{
+			"chat_id": {args[2]},
+			"text":    {deadLetterSummary(letters)},
+		}); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to send notification: %v\n", err)
+			return 1
+		}
+
+	case "clear":
+		if err := withLock(deadLetterFile(), func() error { return writeDeadLetters(nil) }); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to clear dead letters: %v\n", err)
+			return 1
+		}
+
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown deadletter action %q\n", action)
+		return 1
+	}
+
+	return 0
+}
+
+// deadLetterSummary renders a plain-text report that fits one message.
+func deadLetterSummary(letters []deadLetter) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d upload(s) failed permanently:\n", len(letters))
+	for i, letter := range letters {
+		line := fmt.Sprintf("\n• %s → %s\n  %s", filepath.Base(letter.Job.FilePath),
+			strconv.FormatInt(letter.Job.ChatID, 10), letter.Error)
+		if utf16Len(b.String()+line) > messageLimit-50 {
+			fmt.Fprintf(&b, "\n… and %d more", len(letters)-i)
+			break
+		}
+		b.WriteString(line)
+	}
+	return b.String()
+}
@@ -0,0 +1,705 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"sort"
+	"strings"
+	"unicode/utf16"
+)
+
+// messageEntity is a formatted span of message text, as the Bot API
+// reports it. Offsets and lengths are in UTF-16 code units.
+type messageEntity struct {
+	Type     string `json:"type"`
+	Offset   int    `json:"offset"`
+	Length   int    `json:"length"`
+	URL      string `json:"url,omitempty"`
+	Language string `json:"language,omitempty"`
+	EmojiID  string `json:"custom_emoji_id,omitempty"`
+}
+
+// entityBuilder collects the plain text of a message and the entities
+// opened and closed along the way.
+type entityBuilder struct {
+	text     strings.Builder
+	units    int
+	open     []messageEntity
+	entities []messageEntity
+}
+
+func (b *entityBuilder) writeString(s string) {
+	b.text.WriteString(s)
+	b.units += utf16Len(s)
+}
+
+func (b *entityBuilder) start(entity messageEntity) {
+	entity.Offset = b.units
+	b.open = append(b.open, entity)
+}
+
+// end closes the innermost open entity. Empty entities are dropped, as
+// Telegram does.
+func (b *entityBuilder) end() {
+	entity := b.open[len(b.open)-1]
+	b.open = b.open[:len(b.open)-1]
+	if entity.Length = b.units - entity.Offset; entity.Length > 0 {
+		b.entities = append(b.entities, entity)
+	}
+}
+
+// top returns the innermost open entity, or nil.
+func (b *entityBuilder) top() *messageEntity {
+	if len(b.open) == 0 {
+		return nil
+	}
+	return &b.open[len(b.open)-1]
+}
+
+func (b *entityBuilder) isOpen(kind string) bool {
+	for _, entity := range b.open {
+		if entity.Type == kind {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *entityBuilder) finish() (string, []messageEntity, error) {
+	if entity := b.top(); entity != nil {
+		return "", nil, fmt.Errorf("can't find end of %s entity", entity.Type)
+	}
+	// Entities covering the same span are ordered by type, so the order
+	// doesn't depend on how they were nested
+	sort.SliceStable(b.entities, func(i, j int) bool {
+		if b.entities[i].Offset != b.entities[j].Offset {
+			return b.entities[i].Offset < b.entities[j].Offset
+		}
+		if b.entities[i].Length != b.entities[j].Length {
+			return b.entities[i].Length > b.entities[j].Length
+		}
+		return b.entities[i].Type < b.entities[j].Type
+	})
+	return b.text.String(), b.entities, nil
+}
+
+// parseEntities resolves text in the given parse mode the way the Bot API
+// does, returning the text as displayed and its entities. Errors mirror
+// Telegram's "can't parse entities" rejections.
+func parseEntities(text, parseMode string) (string, []messageEntity, error) {
+	switch strings.ToLower(parseMode) {
+	case "":
+		return text, nil, nil
+	case "html":
+		return parseHTMLEntities(text)
+	case "markdownv2":
+		return parseMarkdownV2Entities(text)
+	case "markdown":
+		return parseMarkdownEntities(text)
+	}
+	return "", nil, fmt.Errorf("unsupported parse mode %q", parseMode)
+}
+
+// htmlTags maps the tags Telegram accepts to entity types.
+var htmlTags = map[string]string{
+	"b": "bold", "strong": "bold",
+	"i": "italic", "em": "italic",
+	"u": "underline", "ins": "underline",
+	"s": "strikethrough", "strike": "strikethrough", "del": "strikethrough",
+	"tg-spoiler": "spoiler",
+	"a":          "text_link",
+	"code":       "code",
+	"pre":        "pre",
+	"blockquote": "blockquote",
+	"tg-emoji":   "custom_emoji",
+	"span":       "spoiler",
+}
+
+func parseHTMLEntities(text string) (string, []messageEntity, error) {
+	var b entityBuilder
+	var tags []string
+	for text != "" {
+		lt := strings.IndexByte(text, '<')
+		if lt < 0 {
+			b.writeString(html.UnescapeString(text))
+			break
+		}
+		b.writeString(html.UnescapeString(text[:lt]))
+		gt := strings.IndexByte(text[lt:], '>')
+		if gt < 0 {
+			return "", nil, fmt.Errorf("unclosed start tag at byte offset %d", lt)
+		}
+		tag := text[lt+1 : lt+gt]
+		text = text[lt+gt+1:]
+
+		if name := strings.TrimPrefix(tag, "/"); name != tag {
+			name = strings.ToLower(strings.TrimSpace(name))
+			if len(tags) == 0 || tags[len(tags)-1] != name {
+				return "", nil, fmt.Errorf("unmatched end tag %q", name)
+			}
+			tags = tags[:len(tags)-1]
+			// <pre><code class="language-x"> is a single pre entity
+			if name == "code" && b.top().Type == "pre" {
+				continue
+			}
+			b.end()
+			continue
+		}
+
+		name, attrs := parseHTMLTag(tag)
+		kind, ok := htmlTags[name]
+		if !ok || name == "span" && attrs["class"] != "tg-spoiler" {
+			return "", nil, fmt.Errorf("unsupported start tag %q", name)
+		}
+		tags = append(tags, name)
+		entity := messageEntity{Type: kind}
+		switch name {
+		case "a":
+			entity.URL = attrs["href"]
+			if entity.URL == "" {
+				return "", nil, fmt.Errorf("<a> tag without href")
+			}
+		case "code":
+			// A code tag directly inside pre sets the pre's language
+			if top := b.top(); top != nil && top.Type == "pre" && top.Offset == b.units {
+				top.Language = strings.TrimPrefix(attrs["class"], "language-")
+				continue
+			}
+		case "blockquote":
+			if _, ok := attrs["expandable"]; ok {
+				entity.Type = "expandable_blockquote"
+			}
+		case "tg-emoji":
+			if entity.EmojiID = attrs["emoji-id"]; entity.EmojiID == "" {
+				return "", nil, fmt.Errorf("<tg-emoji> tag without emoji-id")
+			}
+		}
+		b.start(entity)
+	}
+	if len(tags) > 0 {
+		return "", nil, fmt.Errorf("can't find end tag corresponding to start tag %q", tags[len(tags)-1])
+	}
+	return b.finish()
+}
+
+// parseHTMLTag splits the inside of a start tag into its lower-cased name
+// and attributes.
+func parseHTMLTag(tag string) (string, map[string]string) {
+	tag = strings.TrimSuffix(strings.TrimSpace(tag), "/")
+	name, rest, _ := strings.Cut(tag, " ")
+	attrs := make(map[string]string)
+	for rest = strings.TrimSpace(rest); rest != ""; rest = strings.TrimSpace(rest) {
+		end := strings.IndexAny(rest, "= ")
+		if end < 0 || rest[end] == ' ' {
+			// An attribute without a value, e.g. expandable
+			if end < 0 {
+				end = len(rest)
+			}
+			attrs[strings.ToLower(rest[:end])] = ""
+			rest = rest[end:]
+			continue
+		}
+		key := strings.ToLower(strings.TrimSpace(rest[:end]))
+		rest = strings.TrimSpace(rest[end+1:])
+		var value string
+		if rest != "" && (rest[0] == '"' || rest[0] == '\'') {
+			if closing := strings.IndexByte(rest[1:], rest[0]); closing < 0 {
+				value, rest = rest[1:], ""
+			} else {
+				value, rest = rest[1:closing+1], rest[closing+2:]
+			}
+		} else {
+			value, rest, _ = strings.Cut(rest, " ")
+		}
+		attrs[key] = html.UnescapeString(value)
+	}
+	return strings.ToLower(name), attrs
+}
+
+// markdownV2Reserved must be escaped with a backslash outside entities.
+const markdownV2Reserved = "_*[]()~`>#+-=|{}.!"
+
+func parseMarkdownV2Entities(text string) (string, []messageEntity, error) {
+	var b entityBuilder
+	runes := []rune(text)
+	atLineStart := true
+	// toggle closes an entity of this kind if it is the innermost one, or
+	// opens it
+	toggle := func(kind string) error {
+		if top := b.top(); top != nil && top.Type == kind {
+			b.end()
+			return nil
+		}
+		if b.isOpen(kind) {
+			return fmt.Errorf("%s entity overlaps another entity", kind)
+		}
+		b.start(messageEntity{Type: kind})
+		return nil
+	}
+
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		lineStart := atLineStart
+		atLineStart = r == '\n'
+
+		if r == '\\' && i+1 < len(runes) {
+			i++
+			b.writeString(string(runes[i]))
+			continue
+		}
+
+		// Code and pre are literal apart from escapes
+		if top := b.top(); top != nil && (top.Type == "code" || top.Type == "pre") {
+			switch {
+			case top.Type == "pre" && hasRunes(runes[i:], "```"):
+				b.end()
+				i += 2
+			case top.Type == "code" && r == '`':
+				b.end()
+			default:
+				b.writeString(string(r))
+			}
+			continue
+		}
+
+		switch {
+		case r == '\r' && i > 0 && runes[i-1] == '_' && i+1 < len(runes) && runes[i+1] == '_':
+			// Separates italic and underline markers, as in _\r__
+		case r == '\n':
+			// A quote ends with the first line not starting with >
+			if top := b.top(); top != nil && strings.HasSuffix(top.Type, "blockquote") &&
+				(i+1 >= len(runes) || runes[i+1] != '>') {
+				b.end()
+			}
+			b.writeString("\n")
+		case r == '>' && lineStart:
+			if top := b.top(); top == nil || !strings.HasSuffix(top.Type, "blockquote") {
+				b.start(messageEntity{Type: "blockquote"})
+			}
+		case hasRunes(runes[i:], "**>") && lineStart:
+			b.start(messageEntity{Type: "expandable_blockquote"})
+			i += 2
+		case hasRunes(runes[i:], "```"):
+			i += 3
+			language := ""
+			for i < len(runes) && runes[i] != '\n' && !hasRunes(runes[i:], "```") {
+				language += string(runes[i])
+				i++
+			}
+			if i < len(runes) && runes[i] != '\n' {
+				// ```code``` on one line: what looked like a language is content
+				b.start(messageEntity{Type: "pre"})
+				b.writeString(language)
+				i--
+				continue
+			}
+			b.start(messageEntity{Type: "pre", Language: language})
+		case r == '`':
+			b.start(messageEntity{Type: "code"})
+		case r == '*':
+			if err := toggle("bold"); err != nil {
+				return "", nil, err
+			}
+		case hasRunes(runes[i:], "__"):
+			if err := toggle("underline"); err != nil {
+				return "", nil, err
+			}
+			i++
+		case r == '_':
+			if err := toggle("italic"); err != nil {
+				return "", nil, err
+			}
+		case r == '~':
+			if err := toggle("strikethrough"); err != nil {
+				return "", nil, err
+			}
+		case hasRunes(runes[i:], "||") && b.top() != nil && b.top().Type == "expandable_blockquote" &&
+			(i+2 == len(runes) || runes[i+2] == '\n'):
+			// || at the end of its last line closes an expandable quote
+			b.end()
+			i++
+		case hasRunes(runes[i:], "||"):
+			if err := toggle("spoiler"); err != nil {
+				return "", nil, err
+			}
+			i++
+		case r == '[':
+			b.start(messageEntity{Type: "text_link"})
+		case hasRunes(runes[i:], "!["):
+			b.start(messageEntity{Type: "custom_emoji"})
+			i++
+		case r == ']':
+			top := b.top()
+			if top == nil || top.Type != "text_link" && top.Type != "custom_emoji" {
+				return "", nil, fmt.Errorf("character ']' is reserved and must be escaped with the preceding '\\'")
+			}
+			if i+1 >= len(runes) || runes[i+1] != '(' {
+				return "", nil, fmt.Errorf("link text must be followed by its URL in parentheses")
+			}
+			url := ""
+			for i += 2; i < len(runes) && runes[i] != ')'; i++ {
+				if runes[i] == '\\' && i+1 < len(runes) {
+					i++
+				}
+				url += string(runes[i])
+			}
+			if i >= len(runes) {
+				return "", nil, fmt.Errorf("can't find end of a URL")
+			}
+			if top.Type == "custom_emoji" {
+				top.EmojiID = strings.TrimPrefix(url, "tg://emoji?id=")
+			} else {
+				top.URL = url
+			}
+			b.end()
+		case strings.ContainsRune(markdownV2Reserved, r):
+			return "", nil, fmt.Errorf("character '%c' is reserved and must be escaped with the preceding '\\'", r)
+		default:
+			b.writeString(string(r))
+		}
+	}
+	if top := b.top(); top != nil && strings.HasSuffix(top.Type, "blockquote") {
+		b.end()
+	}
+	return b.finish()
+}
+
+// parseMarkdownEntities handles the legacy Markdown mode: no nesting, and
+// only _*`[ are special.
+func parseMarkdownEntities(text string) (string, []messageEntity, error) {
+	var b entityBuilder
+	runes := []rune(text)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		if r == '\\' && i+1 < len(runes) && strings.ContainsRune("_*`[", runes[i+1]) {
+			i++
+			b.writeString(string(runes[i]))
+			continue
+		}
+
+		var kind, closing string
+		switch {
+		case hasRunes(runes[i:], "```"):
+			kind, closing = "pre", "```"
+		case r == '`':
+			kind, closing = "code", "`"
+		case r == '*':
+			kind, closing = "bold", "*"
+		case r == '_':
+			kind, closing = "italic", "_"
+		case r == '[':
+			kind, closing = "text_link", "]"
+		default:
+			b.writeString(string(r))
+			continue
+		}
+
+		i += len([]rune(closing))
+		end := i
+		for end < len(runes) && !hasRunes(runes[end:], closing) {
+			end++
+		}
+		if end >= len(runes) {
+			return "", nil, fmt.Errorf("can't find end of the entity starting at character %d", i-len([]rune(closing)))
+		}
+		entity := messageEntity{Type: kind}
+		content := string(runes[i:end])
+		if kind == "pre" {
+			if language, code, ok := strings.Cut(content, "\n"); ok && !strings.ContainsAny(language, " \t") {
+				entity.Language, content = language, code
+			}
+		}
+		i = end + len([]rune(closing)) - 1
+		if kind == "text_link" {
+			if i+1 >= len(runes) || runes[i+1] != '(' {
+				// A lone [ is just text
+				b.writeString("[" + content + "]")
+				continue
+			}
+			closeParen := i + 2
+			for closeParen < len(runes) && runes[closeParen] != ')' {
+				closeParen++
+			}
+			if closeParen >= len(runes) {
+				return "", nil, fmt.Errorf("can't find end of a URL")
+			}
+			entity.URL = string(runes[i+2 : closeParen])
+			i = closeParen
+		}
+		b.start(entity)
+		b.writeString(content)
+		b.end()
+	}
+	return b.finish()
+}
+
+func utf16Units(s string) []uint16 {
+	return utf16.Encode([]rune(s))
+}
+
+// utf16Slice returns the text an entity covers.
+func utf16Slice(units []uint16, offset, length int) string {
+	if offset+length > len(units) {
+		return ""
+	}
+	return string(utf16.Decode(units[offset : offset+length]))
+}
+
+// hasRunes reports whether runes begins with prefix.
+func hasRunes(runes []rune, prefix string) bool {
+	p := []rune(prefix)
+	if len(runes) < len(p) {
+		return false
+	}
+	for i := range p {
+		if runes[i] != p[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// markupStyle writes entities in one parse mode: marker returns the markup
+// opening or closing an entity, escape the markup for one character inside
+// the entities that are open.
+type markupStyle struct {
+	marker func(entity messageEntity, closing bool) string
+	escape func(r rune, open []messageEntity) string
+}
+
+var htmlEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", `"`, "&quot;")
+
+var htmlStyle = markupStyle{
+	marker: func(entity messageEntity, closing bool) string {
+		var tag, attrs string
+		switch entity.Type {
+		case "bold":
+			tag = "b"
+		case "italic":
+			tag = "i"
+		case "underline":
+			tag = "u"
+		case "strikethrough":
+			tag = "s"
+		case "spoiler":
+			tag = "tg-spoiler"
+		case "code":
+			tag = "code"
+		case "pre":
+			if entity.Language != "" {
+				if closing {
+					return "</code></pre>"
+				}
+				return `<pre><code class="language-` + htmlEscaper.Replace(entity.Language) + `">`
+			}
+			tag = "pre"
+		case "blockquote":
+			tag = "blockquote"
+		case "expandable_blockquote":
+			tag, attrs = "blockquote", " expandable"
+		case "text_link":
+			tag, attrs = "a", ` href="`+htmlEscaper.Replace(entity.URL)+`"`
+		case "custom_emoji":
+			tag, attrs = "tg-emoji", ` emoji-id="`+htmlEscaper.Replace(entity.EmojiID)+`"`
+		default:
+			return ""
+		}
+		if closing {
+			return "</" + tag + ">"
+		}
+		return "<" + tag + attrs + ">"
+	},
+	escape: func(r rune, open []messageEntity) string {
+		return htmlEscaper.Replace(string(r))
+	},
+}
+
+var markdownV2Style = markupStyle{
+	marker: func(entity messageEntity, closing bool) string {
+		switch entity.Type {
+		case "bold":
+			return "*"
+		case "italic":
+			return "_"
+		case "underline":
+			return "__"
+		case "strikethrough":
+			return "~"
+		case "spoiler":
+			return "||"
+		case "code":
+			return "`"
+		case "pre":
+			if closing {
+				return "```"
+			}
+			return "```" + entity.Language + "\n"
+		case "blockquote":
+			if closing {
+				return ""
+			}
+			return ">"
+		case "expandable_blockquote":
+			if closing {
+				return "||"
+			}
+			return "**>"
+		case "text_link":
+			if closing {
+				return "](" + escapeMarkdownV2URL(entity.URL) + ")"
+			}
+			return "["
+		case "custom_emoji":
+			if closing {
+				return "](tg://emoji?id=" + escapeMarkdownV2URL(entity.EmojiID) + ")"
+			}
+			return "!["
+		}
+		return ""
+	},
+	escape: func(r rune, open []messageEntity) string {
+		for _, entity := range open {
+			switch {
+			case entity.Type == "code" || entity.Type == "pre":
+				if r == '`' || r == '\\' {
+					return `\` + string(r)
+				}
+				return string(r)
+			case r == '\n' && strings.HasSuffix(entity.Type, "blockquote"):
+				// Every line of a quote starts with >
+				return "\n>"
+			}
+		}
+		if r == '\\' || strings.ContainsRune(markdownV2Reserved, r) {
+			return `\` + string(r)
+		}
+		return string(r)
+	},
+}
+
+func escapeMarkdownV2URL(url string) string {
+	return strings.NewReplacer(`\`, `\\`, ")", `\)`).Replace(url)
+}
+
+// markdownStyle is the legacy mode, which can't nest entities or escape
+// anything inside them.
+var markdownStyle = markupStyle{
+	marker: func(entity messageEntity, closing bool) string {
+		switch entity.Type {
+		case "bold":
+			return "*"
+		case "italic":
+			return "_"
+		case "code":
+			return "`"
+		case "pre":
+			if closing {
+				return "```"
+			}
+			return "```" + entity.Language + "\n"
+		case "text_link":
+			if closing {
+				return "](" + entity.URL + ")"
+			}
+			return "["
+		}
+		return ""
+	},
+	escape: func(r rune, open []messageEntity) string {
+		if len(open) == 0 && strings.ContainsRune("_*`[", r) {
+			return `\` + string(r)
+		}
+		return string(r)
+	},
+}
+
+// renderEntities is the inverse of parseEntities: it writes the text in
+// units with its entities as markup in parseMode. Entities must nest, as
+// parsed ones do.
+func renderEntities(units []uint16, entities []messageEntity, parseMode string) string {
+	var style markupStyle
+	switch strings.ToLower(parseMode) {
+	case "html":
+		style = htmlStyle
+	case "markdownv2":
+		style = markdownV2Style
+	case "markdown":
+		style = markdownStyle
+	default:
+		return string(utf16.Decode(units))
+	}
+
+	sorted := make([]messageEntity, 0, len(entities))
+	for _, entity := range entities {
+		if entity.Length > 0 {
+			sorted = append(sorted, entity)
+		}
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].Offset != sorted[j].Offset {
+			return sorted[i].Offset < sorted[j].Offset
+		}
+		return sorted[i].Length > sorted[j].Length
+	})
+
+	var b strings.Builder
+	lastMarker := ""
+	mark := func(marker string) {
+		// MarkdownV2 reads ___ as underline first; _\r__ keeps italic and
+		// underline markers apart
+		if marker == "" {
+			return
+		}
+		if strings.EqualFold(parseMode, "MarkdownV2") && strings.HasSuffix(lastMarker, "_") && strings.HasPrefix(marker, "_") {
+			b.WriteString("\r")
+		}
+		b.WriteString(marker)
+		lastMarker = marker
+	}
+	var open []messageEntity
+	next := 0
+	for pos := 0; ; {
+		// Close what ends here, innermost first, then open what starts
+		for len(open) > 0 && open[len(open)-1].Offset+open[len(open)-1].Length <= pos {
+			mark(style.marker(open[len(open)-1], true))
+			open = open[:len(open)-1]
+		}
+		for next < len(sorted) && sorted[next].Offset <= pos {
+			mark(style.marker(sorted[next], false))
+			open = append(open, sorted[next])
+			next++
+		}
+		if pos >= len(units) {
+			break
+		}
+
+		r, size := rune(units[pos]), 1
+		if utf16.IsSurrogate(r) && pos+1 < len(units) {
+			r, size = utf16.DecodeRune(r, rune(units[pos+1])), 2
+		}
+		b.WriteString(style.escape(r, open))
+		lastMarker = ""
+		pos += size
+	}
+	return b.String()
+}
+
+// clipEntities returns the parts of entities within [start, end), with
+// offsets relative to start.
+func clipEntities(entities []messageEntity, start, end int) []messageEntity {
+	var clipped []messageEntity
+	for _, entity := range entities {
+		from, to := entity.Offset, entity.Offset+entity.Length
+		if from < start {
+			from = start
+		}
+		if to > end {
+			to = end
+		}
+		if to > from {
+			entity.Offset, entity.Length = from-start, to-from
+			clipped = append(clipped, entity)
+		}
+	}
+	return clipped
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// fanOutResult is the outcome of sending to one destination chat.
+type fanOutResult struct {
+	MessageID int    `json:"message_id,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// floodGate pauses every fan-out worker together when one of them hits a
+// flood wait, instead of letting each run into the same 429 on its own.
+type floodGate struct {
+	mu    sync.Mutex
+	until time.Time
+}
+
+// pause holds the gate shut for d, warning only when a new storm starts.
+func (g *floodGate) pause(d time.Duration) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	until := time.Now().Add(d)
+	if !until.After(g.until) {
+		return
+	}
+	if time.Now().After(g.until) {
+		logf("Flood wait from Telegram; pausing all sends for %v\n", d)
+	}
+	g.until = until
+}
+
+// wait blocks while the gate is shut.
+func (g *floodGate) wait() {
+	for {
+		g.mu.Lock()
+		remaining := time.Until(g.until)
+		g.mu.Unlock()
+		if remaining <= 0 {
+			return
+		}
+		time.Sleep(remaining)
+	}
+}
+
+func chatTimestampFile(chatID int64) string {
+	return filepath.Join(stateDir(), fmt.Sprintf("last_upload_%d.txt", chatID))
+}
+
+// resultRecord is one line of -json output: a finished send to one chat.
+type resultRecord struct {
+	JobID     string `json:"job_id"`
+	ChatID    int64  `json:"chat_id"`
+	File      string `json:"file"`
+	MessageID int    `json:"message_id,omitempty"`
+	FileID    string `json:"file_id,omitempty"`
+	Error     string `json:"error,omitempty"`
+
+	FileUniqueID string          `json:"file_unique_id,omitempty"`
+	FileSize     int64           `json:"file_size,omitempty"`
+	Date         int64           `json:"date,omitempty"`
+	Message      json.RawMessage `json:"message,omitempty"`
+	Transcoded   bool            `json:"transcoded,omitempty"` // a re-encoded copy was sent
+}
+
+// fanOut resends an uploaded file to more chats by file_id, so the bytes
+// cross the network only once. Chats are served concurrently, each paced by
+// its own last-upload timestamp so --delay also holds per chat. done, if
+// set, is called as each chat finishes.
+func fanOut(opts uploadOptions, uploaded *uploadResult, chatIDs []int64, concurrency int, done func(int64, fanOutResult)) map[int64]fanOutResult {
+	results := make(map[int64]fanOutResult)
+	if uploaded.FileID == "" {
+		for _, chatID := range chatIDs {
+			results[chatID] = fanOutResult{Error: "upload response carried no file_id to resend"}
+		}
+		return results
+	}
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	gate := &floodGate{}
+	slots := make(chan struct{}, concurrency)
+
+	for _, chatID := range chatIDs {
+		wg.Add(1)
+		go func(chatID int64) {
+			defer wg.Done()
+
+			target := opts
+			target.ChatID = chatID
+			// Message and thread IDs are per chat, so the reply target and
+			// topic don't carry over
+			target.ReplyToMessageID = 0
+			target.ThreadID = 0
+
+			// A chat still inside its --delay waits without taking a slot,
+			// so the other chats keep going meanwhile
+			var result fanOutResult
+			err := waitForDelay(chatTimestampFile(chatID), opts.DelaySeconds)
+			if err == nil {
+				slots <- struct{}{}
+				var messageID int
+				messageID, err = sendCopy(target, uploaded, gate)
+				<-slots
+				result.MessageID = messageID
+			}
+			if err != nil {
+				result.Error = err.Error()
+			}
+
+			mu.Lock()
+			results[chatID] = result
+			if done != nil {
+				done(chatID, result)
+			}
+			mu.Unlock()
+		}(chatID)
+	}
+	wg.Wait()
+
+	return results
+}
+
+// sendCopy posts an already uploaded file to opts.ChatID by its file_id.
+// Flood waits are shared through gate with the other workers.
+func sendCopy(opts uploadOptions, uploaded *uploadResult, gate *floodGate) (int, error) {
+	// The caption goes out as the upload fitted it, not as given
+	opts.Caption = uploaded.Caption
+	endpoint, fieldName := sendTarget(opts)
+	fields, err := messageFields(opts, uploaded.FileID)
+	if err != nil {
+		return 0, err
+	}
+	params := url.Values{}
+	for key, value := range fields {
+		params.Set(key, value)
+	}
+	if opts.PaidStars == 0 {
+		params.Set(fieldName, uploaded.FileID)
+	}
+
+	var raw json.RawMessage
+	for attempt := 1; ; attempt++ {
+		gate.wait()
+		raw, err = callAPI(opts.BotToken, endpoint, params)
+		var retryErr *retryableError
+		if newChatID := migratedChat(err); newChatID != 0 && newChatID != opts.ChatID {
+			logf("Chat %d was migrated to %d; sending there instead\n", opts.ChatID, newChatID)
+			if cfgErr := updateMigratedChat(opts.ChatID, newChatID); cfgErr != nil {
+				logf("Warning: failed to update config: %v\n", cfgErr)
+			}
+			opts.ChatID = newChatID
+			params.Set("chat_id", strconv.FormatInt(newChatID, 10))
+			attempt--
+			continue
+		}
+		if errors.As(err, &retryErr) && retryErr.after > 0 {
+			// The whole pool waits this one out; gate.wait does the
+			// sleeping. Flood waits don't use up -retries.
+			gate.pause(retryErr.after)
+			attempt--
+			continue
+		}
+		if err == nil || attempt > opts.Retries || !errors.As(err, &retryErr) {
+			break
+		}
+		logf("Sending to chat %d failed: %v; retrying in %v\n", opts.ChatID, err, opts.RetryDelay)
+		time.Sleep(opts.RetryDelay)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	var message struct {
+		MessageID int `json:"message_id"`
+	}
+	if err := json.Unmarshal(raw, &message); err != nil {
+		return 0, fmt.Errorf("failed to decode response: %v", err)
+	}
+
+	if err := writeTimestamp(chatTimestampFile(opts.ChatID)); err != nil {
+		logf("Warning: failed to write last upload timestamp for chat %d: %v\n", opts.ChatID, err)
+	}
+	if err := appendHistory(historyEntry{
+		Time:      time.Now().UTC(),
+		ChatID:    opts.ChatID,
+		MessageID: message.MessageID,
+		File:      opts.FilePath,
+		FileName:  uploadFilename(opts),
+		Title:     opts.Title,
+		Performer: opts.Performer,
+		Size:      uploaded.Size,
+		SHA256:    uploaded.SHA256,
+		FileID:    uploaded.FileID,
+		Copy:      true,
+		JobID:     opts.JobID,
+	}); err != nil {
+		logf("Warning: failed to record upload history: %v\n", err)
+	}
+
+	// The rest of an overflowing caption follows the copy like the original
+	if len(uploaded.FollowUps) > 0 {
+		if err := sendFollowUps(opts, message.MessageID, uploaded.FollowUps); err != nil {
+			logf("Warning: chat %d: %v\n", opts.ChatID, err)
+		}
+	}
+
+	return message.MessageID, nil
+}
+
+// parseChatList parses comma-separated chat IDs or aliases from repeated
+// flags.
+func parseChatList(cfg *config, values []string) ([]int64, error) {
+	var chatIDs []int64
+	for _, value := range values {
+		for _, field := range splitList(value) {
+			chatID, err := resolveChatID(cfg, field)
+			if err != nil {
+				return nil, fmt.Errorf("invalid chat ID %q", field)
+			}
+			chatIDs = append(chatIDs, chatID)
+		}
+	}
+	return chatIDs, nil
+}
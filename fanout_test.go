@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFanOutSendsFittedCaption(t *testing.T) {
+	var mu sync.Mutex
+	var forms []url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		mu.Lock()
+		forms = append(forms, r.PostForm)
+		mu.Unlock()
+		fmt.Fprint(w, `{"ok":true,"result":{"message_id":9}}`)
+	}))
+	defer server.Close()
+	apiBaseURL = server.URL
+	t.Cleanup(func() { apiBaseURL = defaultAPIURL })
+	t.Setenv(stateDirEnv, t.TempDir())
+
+	long := strings.Repeat("word ", 300)
+	tests := []struct {
+		name string
+		opts uploadOptions
+	}{
+		{"document titled", uploadOptions{FilePath: "notes.bin", Title: long}},
+		{"audio caption", uploadOptions{FilePath: "song.mp3", Title: "Song", Caption: long}},
+		{"html caption", uploadOptions{FilePath: "notes.bin", Caption: "<b>" + long + "</b>", ParseMode: "HTML"}},
+		{"paid video", uploadOptions{FilePath: "clip.mp4", PaidStars: 5, ThumbnailPath: "thumb.jpg", Caption: long}},
+	}
+	for _, tt := range tests {
+		forms = nil
+		fitted, _, err := fitCaption(messageCaption(tt.opts), overflowTruncate, tt.opts.ParseMode)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		uploaded := &uploadResult{ChatID: 1, MessageID: 2, FileID: "FILE", Caption: fitted}
+		tt.opts.BotToken = "1:x"
+
+		results := fanOut(tt.opts, uploaded, []int64{7}, 1, nil)
+		if r := results[7]; r.Error != "" || r.MessageID != 9 {
+			t.Errorf("%s: fanOut = %+v", tt.name, r)
+			continue
+		}
+		if len(forms) != 1 {
+			t.Fatalf("%s: %d requests, want 1", tt.name, len(forms))
+		}
+		if got := forms[0].Get("caption"); got != fitted {
+			t.Errorf("%s: sent a %d-character caption, want the fitted %d-character one", tt.name, len(got), len(fitted))
+		}
+		if media := forms[0].Get("media"); strings.Contains(media, "attach://") {
+			t.Errorf("%s: resend refers to a part it doesn't attach: %s", tt.name, media)
+		}
+	}
+}
+
+func TestFanOutPausesOnFloodWait(t *testing.T) {
+	var mu sync.Mutex
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		n := requests
+		mu.Unlock()
+		// Every chat's first send hits the storm
+		if n <= 3 {
+			fmt.Fprint(w, `{"ok":false,"error_code":429,"description":"Too Many Requests: retry after 1","parameters":{"retry_after":1}}`)
+			return
+		}
+		fmt.Fprintf(w, `{"ok":true,"result":{"message_id":%d}}`, n)
+	}))
+	defer server.Close()
+	apiBaseURL = server.URL
+	t.Cleanup(func() { apiBaseURL = defaultAPIURL })
+	t.Setenv(stateDirEnv, t.TempDir())
+
+	opts := uploadOptions{BotToken: "1:x", FilePath: "notes.bin", Retries: 0}
+	uploaded := &uploadResult{ChatID: 1, MessageID: 2, FileID: "FILE"}
+	start := time.Now()
+	results := fanOut(opts, uploaded, []int64{7, 8, 9}, 3, nil)
+	for chatID, r := range results {
+		if r.Error != "" || r.MessageID == 0 {
+			t.Errorf("chat %d: %+v; a flood wait must not use up -retries 0", chatID, r)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("finished after %v, before the retry_after of 1s", elapsed)
+	}
+	if requests != 6 {
+		t.Errorf("%d requests, want 6", requests)
+	}
+}
+
+func TestFanOutSendsFollowUps(t *testing.T) {
+	var mu sync.Mutex
+	texts := map[string][]string{} // by chat
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		mu.Lock()
+		defer mu.Unlock()
+		if strings.HasSuffix(r.URL.Path, "/sendMessage") {
+			chat := r.PostForm.Get("chat_id")
+			texts[chat] = append(texts[chat], r.PostForm.Get("text"))
+		}
+		fmt.Fprint(w, `{"ok":true,"result":{"message_id":9}}`)
+	}))
+	defer server.Close()
+	apiBaseURL = server.URL
+	t.Cleanup(func() { apiBaseURL = defaultAPIURL })
+	t.Setenv(stateDirEnv, t.TempDir())
+
+	opts := uploadOptions{BotToken: "1:x", FilePath: "notes.bin"}
+	uploaded := &uploadResult{ChatID: 1, MessageID: 2, FileID: "FILE", Caption: "start", FollowUps: []string{"middle", "end"}}
+	results := fanOut(opts, uploaded, []int64{7, 8}, 2, nil)
+	for _, chat := range []int64{7, 8} {
+		if r := results[chat]; r.Error != "" {
+			t.Errorf("chat %d: %s", chat, r.Error)
+		}
+		if got := texts[fmt.Sprint(chat)]; strings.Join(got, "|") != "middle|end" {
+			t.Errorf("chat %d got follow-ups %q, want [middle end]", chat, got)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"unicode"
+)
+
+// Filename rewriting only affects the filename sent in the multipart form;
+// the source file on disk is never renamed.
+
+// latinCompositions maps a combining mark to the base letters it composes
+// with and the resulting precomposed letters, position by position. It
+// covers Latin-1 Supplement and Latin Extended-A, which is what decomposed
+// (NFD) filenames from macOS and some archivers contain in practice.
+var latinCompositions = []struct {
+	mark            rune
+	bases, composed string
+}{
+	{'\u0300', "AEIOUaeiou", "ÀÈÌÒÙàèìòù"},                             // grave accent
+	{'\u0301', "AEIOUYaeiouyCcLlNnRrSsZz", "ÁÉÍÓÚÝáéíóúýĆćĹĺŃńŔŕŚśŹź"}, // acute accent
+	{'\u0302', "AEIOUaeiouCcGgHhJjSsWwYy", "ÂÊÎÔÛâêîôûĈĉĜĝĤĥĴĵŜŝŴŵŶŷ"}, // circumflex accent
+	{'\u0303', "ANOanoIiUu", "ÃÑÕãñõĨĩŨũ"},                             // tilde
+	{'\u0304', "AaEeIiOoUu", "ĀāĒēĪīŌōŪū"},                             // macron
+	{'\u0306', "AaEeGgIiOoUu", "ĂăĔĕĞğĬĭŎŏŬŭ"},                         // breve
+	{'\u0307', "CcEeGgIZz", "ĊċĖėĠġİŻż"},                               // dot above
+	{'\u0308', "AEIOUaeiouyY", "ÄËÏÖÜäëïöüÿŸ"},                         // diaeresis
+	{'\u030a', "AaUu", "ÅåŮů"},                                         // ring above
+	{'\u030b', "OoUu", "ŐőŰű"},                                         // double acute accent
+	{'\u030c', "CcDdEeLlNnRrSsTtZz", "ČčĎďĚěĽľŇňŘřŠšŤťŽž"},             // caron
+	{'\u0327', "CcGgKkLlNnRrSsTt", "ÇçĢģĶķĻļŅņŖŗŞşŢţ"},                 // cedilla
+	{'\u0328', "AaEeIiUu", "ĄąĘęĮįŲų"},                                 // ogonek
+}
+
+var (
+	latinCompose   = make(map[[2]rune]rune) // base+mark -> precomposed
+	latinDecompose = make(map[rune]rune)    // precomposed -> base
+)
+
+func init() {
+	for _, c := range latinCompositions {
+		bases, composed := []rune(c.bases), []rune(c.composed)
+		for i := range bases {
+			latinCompose[[2]rune{bases[i], c.mark}] = composed[i]
+			latinDecompose[composed[i]] = bases[i]
+		}
+	}
+}
+
+// transliterations covers letters that are not a base letter plus a mark,
+// and the Cyrillic and Greek alphabets.
+var transliterations = map[rune]string{
+	'ß': "ss", 'Æ': "AE", 'æ': "ae", 'Ø': "O", 'ø': "o", 'Œ': "OE", 'œ': "oe",
+	'Đ': "D", 'đ': "d", 'Ł': "L", 'ł': "l", 'Þ': "Th", 'þ': "th", 'Ð': "D", 'ð': "d",
+	'ı': "i", 'Ħ': "H", 'ħ': "h", 'Ŀ': "L", 'ŀ': "l",
+
+	'А': "A", 'Б': "B", 'В': "V", 'Г': "G", 'Д': "D", 'Е': "E", 'Ё': "Yo", 'Ж': "Zh",
+	'З': "Z", 'И': "I", 'Й': "Y", 'К': "K", 'Л': "L", 'М': "M", 'Н': "N", 'О': "O",
+	'П': "P", 'Р': "R", 'С': "S", 'Т': "T", 'У': "U", 'Ф': "F", 'Х': "Kh", 'Ц': "Ts",
+	'Ч': "Ch", 'Ш': "Sh", 'Щ': "Shch", 'Ъ': "", 'Ы': "Y", 'Ь': "", 'Э': "E", 'Ю': "Yu",
+	'Я': "Ya", 'Є': "Ye", 'І': "I", 'Ї': "Yi", 'Ґ': "G", 'Ў': "U",
+	'а': "a", 'б': "b", 'в': "v", 'г': "g", 'д': "d", 'е': "e", 'ё': "yo", 'ж': "zh",
+	'з': "z", 'и': "i", 'й': "y", 'к': "k", 'л': "l", 'м': "m", 'н': "n", 'о': "o",
+	'п': "p", 'р': "r", 'с': "s", 'т': "t", 'у': "u", 'ф': "f", 'х': "kh", 'ц': "ts",
+	'ч': "ch", 'ш': "sh", 'щ': "shch", 'ъ': "", 'ы': "y", 'ь': "", 'э': "e", 'ю': "yu",
+	'я': "ya", 'є': "ye", 'і': "i", 'ї': "yi", 'ґ': "g", 'ў': "u",
+
+	'Α': "A", 'Β': "V", 'Γ': "G", 'Δ': "D", 'Ε': "E", 'Ζ': "Z", 'Η': "I", 'Θ': "Th",
+	'Ι': "I", 'Κ': "K", 'Λ': "L", 'Μ': "M", 'Ν': "N", 'Ξ': "X", 'Ο': "O", 'Π': "P",
+	'Ρ': "R", 'Σ': "S", 'Τ': "T", 'Υ': "Y", 'Φ': "F", 'Χ': "Ch", 'Ψ': "Ps", 'Ω': "O",
+	'α': "a", 'β': "v", 'γ': "g", 'δ': "d", 'ε': "e", 'ζ': "z", 'η': "i", 'θ': "th",
+	'ι': "i", 'κ': "k", 'λ': "l", 'μ': "m", 'ν': "n", 'ξ': "x", 'ο': "o", 'π': "p",
+	'ρ': "r", 'σ': "s", 'ς': "s", 'τ': "t", 'υ': "y", 'φ': "f", 'χ': "ch", 'ψ': "ps",
+	'ω': "o", 'ά': "a", 'έ': "e", 'ή': "i", 'ί': "i", 'ό': "o", 'ύ': "y", 'ώ': "o",
+}
+
+// normalizeLatin composes base letters followed by a combining mark into
+// their precomposed form, a targeted subset of Unicode NFC.
+func normalizeLatin(s string) string {
+	runes := []rune(s)
+	out := make([]rune, 0, len(runes))
+	for _, r := range runes {
+		if n := len(out); n > 0 {
+			if composed, ok := latinCompose[[2]rune{out[n-1], r}]; ok {
+				out[n-1] = composed
+				continue
+			}
+		}
+		out = append(out, r)
+	}
+	return string(out)
+}
+
+// transliterate rewrites accented Latin, Cyrillic and Greek letters to
+// plain ASCII. Other scripts are left untouched.
+func transliterate(s string) string {
+	var b strings.Builder
+	for _, r := range normalizeLatin(s) {
+		if base, ok := latinDecompose[r]; ok {
+			b.WriteRune(base)
+		} else if latin, ok := transliterations[r]; ok {
+			b.WriteString(latin)
+		} else if unicode.Is(unicode.Mn, r) {
+			// Drop stray combining marks left over from decomposed input
+		} else {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// sanitizeFilename strips characters that break the Content-Disposition
+// header or Telegram's file display: control and invisible formatting
+// characters (including bidi overrides), quotes, path separators and
+// characters reserved on Windows. Runs of whitespace collapse to one space.
+func sanitizeFilename(name string) string {
+	var b strings.Builder
+	lastSpace := false
+	for _, r := range name {
+		switch {
+		case unicode.IsSpace(r):
+			if !lastSpace {
+				b.WriteRune(' ')
+			}
+			lastSpace = true
+			continue
+		case unicode.IsControl(r), unicode.Is(unicode.Cf, r), strings.ContainsRune(`"\/:*?<>|`, r):
+			continue
+		}
+		b.WriteRune(r)
+		lastSpace = false
+	}
+
+	// Judge the name before trimming dots, which would take the dot of a
+	// bare extension like ".mp3" with them
+	cleaned := b.String()
+	if ext := filepath.Ext(cleaned); strings.Trim(strings.TrimSuffix(cleaned, ext), " .") == "" {
+		return "file" + strings.TrimRight(ext, " .")
+	}
+	return strings.Trim(cleaned, " .")
+}
+
+// uploadFilename returns the filename to announce in the multipart form.
+func uploadFilename(opts uploadOptions) string {
+	name := filepath.Base(opts.FilePath)
+	if opts.NormalizeFilename {
+		name = normalizeLatin(name)
+	}
+	if opts.TransliterateFilename {
+		name = transliterate(name)
+	}
+	if opts.SanitizeFilename {
+		name = sanitizeFilename(name)
+	}
+	return name
+}
@@ -0,0 +1,91 @@
+package main
+
+import "testing"
+
+func TestNormalizeLatin(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"Cafe\u0301.mp3", "Caf\u00e9.mp3"},
+		{"Bjo\u0308rk - Jo\u0301ga.flac", "Bj\u00f6rk - J\u00f3ga.flac"},
+		{"Dvor\u030ca\u0301k.ogg", "Dvo\u0159\u00e1k.ogg"},
+		{"Z\u0307o\u0301\u0142w.mp3", "\u017b\u00f3\u0142w.mp3"},
+		// Already composed, and marks with no base to compose with
+		{"Caf\u00e9.mp3", "Caf\u00e9.mp3"},
+		{"\u0301start.mp3", "\u0301start.mp3"},
+		{"x\u0301.bin", "x\u0301.bin"},
+		{"Привет.txt", "Привет.txt"},
+	}
+	for _, tt := range tests {
+		if got := normalizeLatin(tt.in); got != tt.want {
+			t.Errorf("normalizeLatin(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestTransliterate(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"Bjo\u0308rk - Jo\u0301ga.flac", "Bjork - Joga.flac"},
+		{"Bj\u00f6rk - J\u00f3ga.flac", "Bjork - Joga.flac"},
+		{"Straße Æon Øre Łódź.mp3", "Strasse AEon Ore Lodz.mp3"},
+		{"Щедрик - Леонтович.mp3", "Shchedrik - Leontovich.mp3"},
+		{"Їжак і ґанок.ogg", "Yizhak i ganok.ogg"},
+		{"Объём.txt", "Obyom.txt"},
+		{"Θεσσαλονίκη.jpg", "Thessaloniki.jpg"},
+		{"Ψάρι ς.jpg", "Psari s.jpg"},
+		// Other scripts are left alone; stray marks are dropped
+		{"東京 2024.mp4", "東京 2024.mp4"},
+		{"x\u0301y.bin", "xy.bin"},
+		{"plain.txt", "plain.txt"},
+	}
+	for _, tt := range tests {
+		if got := transliterate(tt.in); got != tt.want {
+			t.Errorf("transliterate(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestSanitizeFilename(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"song.mp3", "song.mp3"},
+		{`a"b\c/d:e*f?g<h>i|j.txt`, "abcdefghij.txt"},
+		{"tab\there\nnew  line.txt", "tab here new line.txt"},
+		{"bidi\u202egnp.exe", "bidignp.exe"},
+		{"zero\u200bwidth\ufeff.txt", "zerowidth.txt"},
+		{"bell\x07.bin", "bell.bin"},
+		{"  ..padded..  .txt", "padded.. .txt"},
+		{"trailing dot.", "trailing dot"},
+		// Nothing left of the name itself
+		{`???.mp3`, "file.mp3"},
+		{"\u202e", "file"},
+		{"...", "file"},
+	}
+	for _, tt := range tests {
+		if got := sanitizeFilename(tt.in); got != tt.want {
+			t.Errorf("sanitizeFilename(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestUploadFilename(t *testing.T) {
+	const path = "/music/Bjo\u0308rk?.flac" // decomposed, as macOS writes it
+	tests := []struct {
+		opts uploadOptions
+		want string
+	}{
+		{uploadOptions{FilePath: path}, "Bjo\u0308rk?.flac"},
+		{uploadOptions{FilePath: path, NormalizeFilename: true}, "Bj\u00f6rk?.flac"},
+		{uploadOptions{FilePath: path, TransliterateFilename: true}, "Bjork?.flac"},
+		{uploadOptions{FilePath: path, SanitizeFilename: true}, "Bjo\u0308rk.flac"},
+		{uploadOptions{FilePath: path, NormalizeFilename: true, TransliterateFilename: true, SanitizeFilename: true}, "Bjork.flac"},
+	}
+	for _, tt := range tests {
+		if got := uploadFilename(tt.opts); got != tt.want {
+			t.Errorf("uploadFilename(%+v) = %q, want %q", tt.opts, got, tt.want)
+		}
+	}
+}
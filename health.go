@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// runHealth implements the "health" subcommand. It verifies the bot token
+// with getMe and, when max_age_seconds is given, that the last successful
+// upload is recent enough. The exit code is 0 when healthy and 1 otherwise,
+// so it can be used directly as a Docker HEALTHCHECK or Kubernetes probe.
+func runHealth(args []string) int {
+	fs := flag.NewFlagSet("health", flag.ExitOnError)
+	addConnectionFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: uploader health [connection flags] <bot_token> [max_age_seconds]\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	args = fs.Args()
+
+	if len(args) < 1 {
+		fs.Usage()
+		return 1
+	}
+	if err := setupTransport(); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid connection settings: %v\n", err)
+		return 1
+	}
+
+	botToken := args[0]
+
+	maxAgeSeconds := 0
+	if len(args) > 1 {
+		var err error
+		maxAgeSeconds, err = strconv.Atoi(args[1])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid max_age_seconds: %v\n", err)
+			return 1
+		}
+	}
+
+	healthy := true
+
+	// Token validity
+	raw, err := callAPI(botToken, "getMe", nil)
+	if err != nil {
+		fmt.Printf("token: FAIL (%v)\n", err)
+		healthy = false
+	} else {
+		var me struct {
+			Username string `json:"username"`
+		}
+		json.Unmarshal(raw, &me)
+		fmt.Printf("token: ok (@%s)\n", me.Username)
+	}
+
+	// Uploads can only record themselves if the state is writable
+	if err := checkStateDir(); err != nil {
+		fmt.Printf("state_dir: FAIL (%v)\n", err)
+		healthy = false
+	} else {
+		fmt.Printf("state_dir: ok (%s)\n", stateDir())
+	}
+
+	// Age of the last successful upload
+	lastUploadTime, err := readLastUploadTime()
+	switch {
+	case err != nil:
+		fmt.Printf("last_upload: FAIL (%v)\n", err)
+		healthy = false
+	case lastUploadTime.IsZero():
+		fmt.Printf("last_upload: never\n")
+		if maxAgeSeconds > 0 {
+			healthy = false
+		}
+	default:
+		age := time.Since(lastUploadTime).Round(time.Second)
+		if maxAgeSeconds > 0 && age > time.Duration(maxAgeSeconds)*time.Second {
+			fmt.Printf("last_upload: FAIL (%v ago, limit %ds)\n", age, maxAgeSeconds)
+			healthy = false
+		} else {
+			fmt.Printf("last_upload: ok (%v ago)\n", age)
+		}
+	}
+
+	if !healthy {
+		return 1
+	}
+	return 0
+}
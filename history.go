@@ -0,0 +1,661 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const historyFileName = "history.jsonl"
+
+// historyEntry is one successful upload. The history file holds one JSON
+// object per line and is only ever appended to.
+type historyEntry struct {
+	Time      time.Time `json:"time"`
+	ChatID    int64     `json:"chat_id"`
+	MessageID int       `json:"message_id"`
+	File      string    `json:"file"`      // source path on disk
+	FileName  string    `json:"file_name"` // name as uploaded
+	Title     string    `json:"title,omitempty"`
+	Performer string    `json:"performer,omitempty"`
+	Size      int64     `json:"size"`
+	SHA256    string    `json:"sha256"`
+	FileID    string    `json:"file_id,omitempty"`
+	Copy      bool      `json:"copy,omitempty"` // resent by file_id, no bytes transferred
+	JobID     string    `json:"job_id,omitempty"`
+	Imported  bool      `json:"imported,omitempty"`  // seeded from a chat export
+	Staged    bool      `json:"staged,omitempty"`    // in the staging chat, waiting to be published
+	Published bool      `json:"published,omitempty"` // copied from the staging chat
+}
+
+func historyFile() string {
+	return filepath.Join(stateDir(), historyFileName)
+}
+
+// appendHistory records entry, and trims the history to historyMaxEntries
+// if that is set. It holds the history lock, so no other process's append
+// can fall between a trim's read and rewrite.
+func appendHistory(entry historyEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	return withLock(historyFile(), func() error {
+		count := 0
+		if historyMaxEntries > 0 {
+			if count, err = countHistory(); err != nil {
+				return err
+			}
+		}
+
+		// The ledger goes first, so a crash in between can't leave a post
+		// out of it. A failed ledger append still records the post in the
+		// history, which later runs rely on to find it.
+		var ledgerErr error
+		if ledgerPath != "" && !entry.Imported {
+			ledgerErr = appendLedger(entry)
+		}
+		if err := appendLine(historyFile(), line); err != nil {
+			return err
+		}
+		if historyMaxEntries > 0 {
+			if err := enforceHistoryCap(count + 1); err != nil {
+				logf("Warning: failed to trim upload history: %v\n", err)
+			}
+		}
+		if ledgerErr != nil {
+			return fmt.Errorf("failed to append to ledger: %v", ledgerErr)
+		}
+		return nil
+	})
+}
+
+// withLock runs fn holding an exclusive lock on path, shared with every
+// other uploader process. The lock lives in a "<path>.lock" file beside it,
+// so it survives path being replaced by writeFileAtomic.
+func withLock(path string, fn func() error) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create directory: %v", err)
+	}
+	file, err := os.OpenFile(path+".lock", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open lock file: %v", err)
+	}
+	defer file.Close()
+	if err := lockFile(file); err != nil {
+		return fmt.Errorf("failed to lock %s: %v", path, err)
+	}
+	return fn()
+}
+
+// appendLine appends line to a JSON-lines state file and syncs it.
+func appendLine(path string, line []byte) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	// Terminate a line left unfinished by a crash so it can't swallow ours
+	line = append(line, '\n')
+	if info, err := file.Stat(); err == nil && info.Size() > 0 {
+		last := make([]byte, 1)
+		if _, err := file.ReadAt(last, info.Size()-1); err == nil && last[0] != '\n' {
+			line = append([]byte{'\n'}, line...)
+		}
+	}
+
+	if _, err := file.Write(line); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// readHistory returns all recorded uploads, oldest first. Lines that do not
+// parse (e.g. a write cut short by a crash) are skipped with a warning.
+func readHistory() ([]historyEntry, error) {
+	file, err := os.Open(historyFile())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read upload history: %v", err)
+	}
+	defer file.Close()
+
+	var entries []historyEntry
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		var entry historyEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			logf("Skipping unreadable history line %d: %v\n", lineNo, err)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read upload history: %v", err)
+	}
+	return entries, nil
+}
+
+// lastMessageID returns the most recent message posted to chatID according
+// to the history, or 0 if there is none.
+func lastMessageID(chatID int64) (int, error) {
+	entries, err := readHistory()
+	if err != nil {
+		return 0, err
+	}
+	for i := len(entries) - 1; i >= 0; i-- {
+		if entries[i].ChatID == chatID {
+			return entries[i].MessageID, nil
+		}
+	}
+	return 0, nil
+}
+
+// findUploaded returns the history entry for an earlier upload of the same
+// file to chatID: the same SHA-256, or for imported entries without a hash
+// the same name and size. It returns nil if there is none.
+func findUploaded(chatID int64, path, fileName string) (*historyEntry, error) {
+	entries, err := readHistory()
+	if err != nil {
+		return nil, err
+	}
+	hash, size, err := fileSHA256(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash %s: %v", path, err)
+	}
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+		if e.ChatID != chatID {
+			continue
+		}
+		if e.SHA256 == hash || e.SHA256 == "" && e.FileName == fileName && e.Size == size {
+			touchHistory(e)
+			return &e, nil
+		}
+	}
+	return nil, nil
+}
+
+// historyMaxEntries caps the history size; 0 means unlimited.
+var historyMaxEntries int
+
+// historyKey identifies a history entry by the message it records.
+type historyKey struct {
+	chatID    int64
+	messageID int
+}
+
+// historyUse is one line of the "<history>.used" file: a lookup that found
+// an entry, such as a -job-id rerun or a -skip-existing hit.
+type historyUse struct {
+	ChatID    int64     `json:"chat_id"`
+	MessageID int       `json:"message_id"`
+	Time      time.Time `json:"time"`
+}
+
+func historyUsedFile() string {
+	return historyFile() + ".used"
+}
+
+// touchHistory records that entry was just looked up, so the size cap
+// keeps it over entries nobody has asked for since.
+func touchHistory(entry historyEntry) {
+	line, _ := json.Marshal(historyUse{ChatID: entry.ChatID, MessageID: entry.MessageID, Time: time.Now().UTC()})
+	err := withLock(historyFile(), func() error {
+		return appendLine(historyUsedFile(), line)
+	})
+	if err != nil {
+		logf("Warning: failed to record use of history entry: %v\n", err)
+	}
+}
+
+// readHistoryUses returns when each entry was last looked up, skipping
+// unreadable lines.
+func readHistoryUses() (map[historyKey]time.Time, error) {
+	uses := make(map[historyKey]time.Time)
+	file, err := os.Open(historyUsedFile())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return uses, nil
+		}
+		return nil, fmt.Errorf("failed to read history uses: %v", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var use historyUse
+		if json.Unmarshal(scanner.Bytes(), &use) != nil {
+			continue
+		}
+		key := historyKey{use.ChatID, use.MessageID}
+		if use.Time.After(uses[key]) {
+			uses[key] = use.Time
+		}
+	}
+	return uses, scanner.Err()
+}
+
+// mostRecentlyUsed returns the n entries uploaded or looked up most
+// recently, in their original order.
+func mostRecentlyUsed(entries []historyEntry, uses map[historyKey]time.Time, n int) []historyEntry {
+	if len(entries) <= n {
+		return entries
+	}
+	lastUsed := func(i int) time.Time {
+		if used := uses[historyKey{entries[i].ChatID, entries[i].MessageID}]; used.After(entries[i].Time) {
+			return used
+		}
+		return entries[i].Time
+	}
+	order := make([]int, len(entries))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(a, b int) bool {
+		ta, tb := lastUsed(order[a]), lastUsed(order[b])
+		if !ta.Equal(tb) {
+			return ta.After(tb)
+		}
+		return order[a] > order[b]
+	})
+
+	keep := make([]bool, len(entries))
+	for _, i := range order[:n] {
+		keep[i] = true
+	}
+	kept := make([]historyEntry, 0, n)
+	for i, e := range entries {
+		if keep[i] {
+			kept = append(kept, e)
+		}
+	}
+	return kept
+}
+
+// historyCount is the number of history entries, kept in a
+// "<history>.count" file so the size cap needn't read the history after
+// every upload. Size is the history's size at that count; a history of any
+// other size was changed behind its back and is counted again.
+type historyCount struct {
+	Entries int   `json:"entries"`
+	Size    int64 `json:"size"`
+}
+
+func historyCountFile() string {
+	return historyFile() + ".count"
+}
+
+// countHistory returns the number of history entries, from the count file
+// when that is current.
+func countHistory() (int, error) {
+	size := int64(0)
+	if info, err := os.Stat(historyFile()); err == nil {
+		size = info.Size()
+	} else if !os.IsNotExist(err) {
+		return 0, fmt.Errorf("failed to read upload history: %v", err)
+	}
+
+	var count historyCount
+	if data, err := os.ReadFile(historyCountFile()); err == nil && json.Unmarshal(data, &count) == nil && count.Size == size {
+		return count.Entries, nil
+	}
+	entries, err := readHistory()
+	if err != nil {
+		return 0, err
+	}
+	return len(entries), nil
+}
+
+// saveHistoryCount records that the history now holds entries.
+func saveHistoryCount(entries int) {
+	info, err := os.Stat(historyFile())
+	if err != nil {
+		return
+	}
+	data, _ := json.Marshal(historyCount{Entries: entries, Size: info.Size()})
+	if err := writeFileAtomic(historyCountFile(), data, 0644); err != nil {
+		logf("Warning: failed to write history count: %v\n", err)
+	}
+}
+
+// rewriteHistory atomically replaces the history with entries, keeping
+// only the uses of entries still in it. The caller holds the history lock.
+func rewriteHistory(entries []historyEntry, uses map[historyKey]time.Time) error {
+	var buf, usedBuf strings.Builder
+	for _, e := range entries {
+		line, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+
+		key := historyKey{e.ChatID, e.MessageID}
+		if used, ok := uses[key]; ok {
+			line, _ := json.Marshal(historyUse{ChatID: e.ChatID, MessageID: e.MessageID, Time: used})
+			usedBuf.Write(line)
+			usedBuf.WriteByte('\n')
+			// Only one line per entry
+			delete(uses, key)
+		}
+	}
+	if err := writeFileAtomic(historyFile(), []byte(buf.String()), 0644); err != nil {
+		return err
+	}
+	saveHistoryCount(len(entries))
+	if err := writeFileAtomic(historyUsedFile(), []byte(usedBuf.String()), 0644); err != nil {
+		logf("Warning: failed to write history uses: %v\n", err)
+	}
+	return nil
+}
+
+// enforceHistoryCap evicts the least recently used entries once the
+// history's count entries exceed historyMaxEntries by 10%, so the rewrite
+// cost is amortized over many uploads instead of being paid on every one.
+// The caller holds the history lock.
+func enforceHistoryCap(count int) error {
+	if count <= historyMaxEntries+historyMaxEntries/10 {
+		saveHistoryCount(count)
+		return nil
+	}
+
+	entries, err := readHistory()
+	if err != nil {
+		return err
+	}
+	uses, err := readHistoryUses()
+	if err != nil {
+		return err
+	}
+	return rewriteHistory(mostRecentlyUsed(entries, uses, historyMaxEntries), uses)
+}
+
+// parseAge parses a duration that may also be given in days, e.g. "90d".
+func parseAge(value string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, fmt.Errorf("invalid age %q", value)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(value)
+}
+
+// runHistoryPrune implements "history prune".
+func runHistoryPrune(args []string) int {
+	fs := flag.NewFlagSet("history prune", flag.ExitOnError)
+	olderThan := fs.String("older-than", "", "remove entries older than this age, e.g. 90d or 720h")
+	keep := fs.Int("keep", 0, "keep only this many most recently uploaded or looked up entries")
+	dryRun := fs.Bool("dry-run", false, "report what would be removed without changing anything")
+	fs.Parse(args)
+
+	if *olderThan == "" && *keep <= 0 {
+		fmt.Fprintf(os.Stderr, "Usage: uploader history prune [-older-than age] [-keep n] [-dry-run]\n")
+		return 1
+	}
+
+	var age time.Duration
+	if *olderThan != "" {
+		var err error
+		if age, err = parseAge(*olderThan); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid -older-than: %v\n", err)
+			return 1
+		}
+	}
+
+	// Hold the lock so uploads running meanwhile aren't lost in the rewrite
+	err := withLock(historyFile(), func() error {
+		entries, err := readHistory()
+		if err != nil {
+			return err
+		}
+		uses, err := readHistoryUses()
+		if err != nil {
+			return err
+		}
+
+		kept := entries
+		if *olderThan != "" {
+			cutoff := time.Now().Add(-age)
+			kept = kept[:0:0]
+			for _, e := range entries {
+				if !e.Time.Before(cutoff) {
+					kept = append(kept, e)
+				}
+			}
+		}
+		if *keep > 0 {
+			kept = mostRecentlyUsed(kept, uses, *keep)
+		}
+
+		removed := len(entries) - len(kept)
+		if *dryRun {
+			fmt.Printf("Would remove %d of %d entries\n", removed, len(entries))
+			return nil
+		}
+		if removed == 0 {
+			fmt.Printf("Nothing to remove (%d entries)\n", len(entries))
+			return nil
+		}
+		if err := rewriteHistory(kept, uses); err != nil {
+			return fmt.Errorf("failed to prune history: %v", err)
+		}
+		fmt.Printf("Removed %d of %d entries\n", removed, len(entries))
+		return nil
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// historyFilter selects history entries by date range, chat and text.
+type historyFilter struct {
+	since, until time.Time
+	chatID       int64
+	query        string
+}
+
+func (f *historyFilter) match(e historyEntry) bool {
+	if !f.since.IsZero() && e.Time.Before(f.since) {
+		return false
+	}
+	if !f.until.IsZero() && !e.Time.Before(f.until) {
+		return false
+	}
+	if f.chatID != 0 && e.ChatID != f.chatID {
+		return false
+	}
+	if f.query != "" {
+		q := strings.ToLower(f.query)
+		if !strings.Contains(strings.ToLower(e.FileName), q) &&
+			!strings.Contains(strings.ToLower(e.File), q) &&
+			!strings.Contains(strings.ToLower(e.Title), q) &&
+			!strings.Contains(strings.ToLower(e.Performer), q) &&
+			!strings.HasPrefix(e.SHA256, q) {
+			return false
+		}
+	}
+	return true
+}
+
+// parseHistoryTime accepts a date (YYYY-MM-DD, local time) or RFC 3339.
+func parseHistoryTime(value string) (time.Time, error) {
+	if t, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// runHistory implements the "history" subcommand.
+func runHistory(args []string) int {
+	if len(args) < 1 {
+		fmt.Fprintf(os.Stderr, "Usage: uploader history list|search|export|prune [flags]\n")
+		return 1
+	}
+	action := args[0]
+	if action == "prune" {
+		return runHistoryPrune(args[1:])
+	}
+
+	fs := flag.NewFlagSet("history "+action, flag.ExitOnError)
+	since := fs.String("since", "", "only uploads at or after this date (YYYY-MM-DD or RFC 3339)")
+	until := fs.String("until", "", "only uploads before this date (YYYY-MM-DD or RFC 3339)")
+	chat := fs.Int64("chat", 0, "only uploads to this chat ID")
+	limit := fs.Int("limit", 0, "show at most this many of the most recent matches (0 = all)")
+	format := fs.String("format", "json", "export format: json or csv")
+	output := fs.String("output", "", "export to this file instead of stdout")
+	fs.Usage = func() {
+		switch action {
+		case "search":
+			fmt.Fprintf(os.Stderr, "Usage: uploader history search [flags] <query>\n")
+		default:
+			fmt.Fprintf(os.Stderr, "Usage: uploader history %s [flags]\n", action)
+		}
+		fs.PrintDefaults()
+	}
+	fs.Parse(args[1:])
+
+	filter := historyFilter{chatID: *chat}
+	var err error
+	if *since != "" {
+		if filter.since, err = parseHistoryTime(*since); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid -since: %v\n", err)
+			return 1
+		}
+	}
+	if *until != "" {
+		if filter.until, err = parseHistoryTime(*until); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid -until: %v\n", err)
+			return 1
+		}
+	}
+
+	switch action {
+	case "list", "export":
+	case "search":
+		if fs.NArg() < 1 {
+			fs.Usage()
+			return 1
+		}
+		filter.query = strings.Join(fs.Args(), " ")
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown history action %q\n", action)
+		return 1
+	}
+
+	entries, err := readHistory()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+
+	var matches []historyEntry
+	for _, e := range entries {
+		if filter.match(e) {
+			matches = append(matches, e)
+		}
+	}
+	if *limit > 0 && len(matches) > *limit {
+		matches = matches[len(matches)-*limit:]
+	}
+
+	if action != "export" {
+		printHistory(os.Stdout, matches)
+		return 0
+	}
+
+	out := io.Writer(os.Stdout)
+	if *output != "" {
+		file, err := os.Create(*output)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to create export file: %v\n", err)
+			return 1
+		}
+		defer file.Close()
+		out = file
+	}
+
+	switch *format {
+	case "json":
+		err = exportHistoryJSON(out, matches)
+	case "csv":
+		err = exportHistoryCSV(out, matches)
+	default:
+		err = fmt.Errorf("unknown export format %q", *format)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Export failed: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+func printHistory(out io.Writer, entries []historyEntry) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tCHAT\tMESSAGE\tSIZE\tSHA256\tFILE")
+	for _, e := range entries {
+		hash := e.SHA256
+		if len(hash) > 12 {
+			hash = hash[:12]
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%s\t%s\n",
+			e.Time.Local().Format("2006-01-02 15:04:05"), e.ChatID, e.MessageID, e.Size, hash, e.FileName)
+	}
+	w.Flush()
+}
+
+func exportHistoryJSON(out io.Writer, entries []historyEntry) error {
+	if entries == nil {
+		entries = []historyEntry{}
+	}
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(entries)
+}
+
+func exportHistoryCSV(out io.Writer, entries []historyEntry) error {
+	w := csv.NewWriter(out)
+	w.Write([]string{"time", "chat_id", "message_id", "file", "file_name", "title", "performer", "size", "sha256", "file_id"})
+	for _, e := range entries {
+		w.Write([]string{
+			e.Time.Format(time.RFC3339),
+			strconv.FormatInt(e.ChatID, 10),
+			strconv.Itoa(e.MessageID),
+			e.File,
+			e.FileName,
+			e.Title,
+			e.Performer,
+			strconv.FormatInt(e.Size, 10),
+			e.SHA256,
+			e.FileID,
+		})
+	}
+	w.Flush()
+	return w.Error()
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMostRecentlyUsed(t *testing.T) {
+	at := func(minute int) time.Time { return time.Date(2026, 1, 1, 0, minute, 0, 0, time.UTC) }
+	entries := []historyEntry{
+		{ChatID: 1, MessageID: 1, Time: at(1)},
+		{ChatID: 1, MessageID: 2, Time: at(2)},
+		{ChatID: 1, MessageID: 3, Time: at(3)},
+		{ChatID: 2, MessageID: 1, Time: at(4)},
+	}
+	tests := []struct {
+		name string
+		uses map[historyKey]time.Time
+		n    int
+		want []int // indexes into entries
+	}{
+		{"under the cap", nil, 5, []int{0, 1, 2, 3}},
+		{"newest without uses", nil, 2, []int{2, 3}},
+		{"looked-up entry survives", map[historyKey]time.Time{{1, 1}: at(10)}, 2, []int{0, 3}},
+		{"use older than upload", map[historyKey]time.Time{{1, 1}: at(0)}, 2, []int{2, 3}},
+		{"use in another chat", map[historyKey]time.Time{{2, 2}: at(10)}, 1, []int{3}},
+		{"ties keep the later entry", map[historyKey]time.Time{{1, 1}: at(4)}, 1, []int{3}},
+	}
+	for _, tt := range tests {
+		var want []historyEntry
+		for _, i := range tt.want {
+			want = append(want, entries[i])
+		}
+		if got := mostRecentlyUsed(entries, tt.uses, tt.n); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, want)
+		}
+	}
+}
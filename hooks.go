@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+)
+
+// shellCommand runs command through the platform shell.
+func shellCommand(command string) *exec.Cmd {
+	if runtime.GOOS == "windows" {
+		return exec.Command("cmd", "/C", command)
+	}
+	return exec.Command("sh", "-c", command)
+}
+
+// runHook runs a user-supplied shell command with the job details exposed as
+// UPLOADER_* environment variables. The hook's stdout goes to stderr so it
+// can never be mistaken for the message ID printed on stdout.
+func runHook(command string, opts uploadOptions, messageID int, uploadErr error) error {
+	cmd := shellCommand(command)
+
+	status := "pending"
+	errText := ""
+	if messageID != 0 {
+		status = "success"
+	} else if uploadErr != nil {
+		status = "failure"
+		errText = uploadErr.Error()
+	}
+
+	cmd.Env = append(os.Environ(),
+		"UPLOADER_JOB_ID="+opts.JobID,
+		"UPLOADER_FILE="+opts.FilePath,
+		"UPLOADER_CHAT_ID="+strconv.FormatInt(opts.ChatID, 10),
+		"UPLOADER_TITLE="+opts.Title,
+		"UPLOADER_PERFORMER="+opts.Performer,
+		"UPLOADER_MESSAGE_ID="+strconv.Itoa(messageID),
+		"UPLOADER_STATUS="+status,
+		"UPLOADER_ERROR="+errText,
+	)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("hook %q failed: %v", command, err)
+	}
+	return nil
+}
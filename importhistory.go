@@ -0,0 +1,164 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// desktopExport is the part of a Telegram Desktop "Export chat history"
+// result.json that matters for seeding the history.
+type desktopExport struct {
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	ID       int64  `json:"id"`
+	Messages []struct {
+		ID           int    `json:"id"`
+		Type         string `json:"type"`
+		DateUnixtime string `json:"date_unixtime"`
+		File         string `json:"file"`
+		FileName     string `json:"file_name"`
+		FileSize     int64  `json:"file_size"`
+		Photo        string `json:"photo"`
+		Title        string `json:"title"`
+		Performer    string `json:"performer"`
+	} `json:"messages"`
+}
+
+// botChatID converts an export's chat ID to the Bot API form: channels and
+// supergroups get the -100 prefix, basic groups are negative.
+func botChatID(chatType string, id int64) int64 {
+	switch {
+	case strings.HasSuffix(chatType, "_channel"), strings.HasSuffix(chatType, "_supergroup"):
+		n, _ := strconv.ParseInt("-100"+strconv.FormatInt(id, 10), 10, 64)
+		return n
+	case chatType == "private_group":
+		return -id
+	}
+	return id
+}
+
+// fileSHA256 hashes a file the same way uploads are hashed.
+func fileSHA256(path string) (string, int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer file.Close()
+	hasher := sha256.New()
+	size, err := io.Copy(hasher, file)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), size, nil
+}
+
+// runImportHistory implements the "import-history" subcommand.
+func runImportHistory(args []string) int {
+	fs := flag.NewFlagSet("import-history", flag.ExitOnError)
+	chat := fs.Int64("chat", 0, "Bot API chat ID to record the messages under (default: derived from the export)")
+	dryRun := fs.Bool("dry-run", false, "report what would be imported without changing anything")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: uploader import-history [flags] <result.json>\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() < 1 {
+		fs.Usage()
+		return 1
+	}
+
+	exportPath := fs.Arg(0)
+	data, err := os.ReadFile(exportPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read export: %v\n", err)
+		return 1
+	}
+	var export desktopExport
+	if err := json.Unmarshal(data, &export); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to parse export: %v\n", err)
+		return 1
+	}
+	chatID := *chat
+	if chatID == 0 {
+		if export.ID == 0 {
+			fmt.Fprintf(os.Stderr, "The export has no chat ID; pass -chat\n")
+			return 1
+		}
+		chatID = botChatID(export.Type, export.ID)
+	}
+
+	entries, err := readHistory()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	known := make(map[int]bool)
+	for _, e := range entries {
+		if e.ChatID == chatID {
+			known[e.MessageID] = true
+		}
+	}
+
+	exportDir := filepath.Dir(exportPath)
+	imported, skipped := 0, 0
+	for _, m := range export.Messages {
+		file := m.File
+		if file == "" {
+			file = m.Photo
+		}
+		if m.Type != "message" || file == "" {
+			continue
+		}
+		if known[m.ID] {
+			skipped++
+			continue
+		}
+
+		entry := historyEntry{
+			ChatID:    chatID,
+			MessageID: m.ID,
+			FileName:  m.FileName,
+			Title:     m.Title,
+			Performer: m.Performer,
+			Size:      m.FileSize,
+			Imported:  true,
+		}
+		if unix, err := strconv.ParseInt(m.DateUnixtime, 10, 64); err == nil {
+			entry.Time = time.Unix(unix, 0).UTC()
+		}
+		// Exports made without media carry a placeholder instead of a path
+		if !strings.HasPrefix(file, "(") {
+			path := filepath.Join(exportDir, filepath.FromSlash(file))
+			if hash, size, err := fileSHA256(path); err == nil {
+				entry.File, entry.SHA256, entry.Size = path, hash, size
+			}
+			if entry.FileName == "" {
+				entry.FileName = filepath.Base(file)
+			}
+		}
+
+		if !*dryRun {
+			if err := appendHistory(entry); err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to record message %d: %v\n", m.ID, err)
+				return 1
+			}
+		}
+		imported++
+	}
+
+	verb := "Imported"
+	if *dryRun {
+		verb = "Would import"
+	}
+	fmt.Printf("%s %d message(s) from %q into chat %d (%d already known)\n", verb, imported, export.Name, chatID, skipped)
+	return 0
+}
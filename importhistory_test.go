@@ -0,0 +1,25 @@
+package main
+
+import "testing"
+
+func TestBotChatID(t *testing.T) {
+	tests := []struct {
+		chatType string
+		id       int64
+		want     int64
+	}{
+		{"public_channel", 1234567890, -1001234567890},
+		{"private_channel", 42, -10042},
+		{"public_supergroup", 1234567890, -1001234567890},
+		{"private_supergroup", 987, -100987},
+		{"private_group", 4321, -4321},
+		{"personal_chat", 5555, 5555},
+		{"bot_chat", 77, 77},
+		{"saved_messages", 1, 1},
+	}
+	for _, tt := range tests {
+		if got := botChatID(tt.chatType, tt.id); got != tt.want {
+			t.Errorf("botChatID(%q, %d) = %d, want %d", tt.chatType, tt.id, got, tt.want)
+		}
+	}
+}
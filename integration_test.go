@@ -0,0 +1,220 @@
+//go:build integration
+
+// End-to-end tests against a real telegram-bot-api server, run with
+//
+//	go test -tags integration -v
+//
+// The tests don't start a server and CI doesn't run them: start one in
+// local mode by hand first, which lifts the 50 MB upload limit the
+// large-file test needs, e.g.
+//
+//	docker run -d -p 8081:8081 \
+//		-e TELEGRAM_API_ID=... -e TELEGRAM_API_HASH=... -e TELEGRAM_LOCAL=1 \
+//		aiogram/telegram-bot-api
+//
+// The server talks to Telegram itself, so the tests need a test bot and a
+// chat it may post in:
+//
+//	UPLOADER_IT_TOKEN    bot token (tests are skipped without it)
+//	UPLOADER_IT_CHAT_ID  chat to post in
+//	UPLOADER_IT_API_URL  server URL (default http://localhost:8081)
+//
+// Every message posted is deleted again.
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+type integrationEnv struct {
+	token  string
+	chatID int64
+}
+
+func setupIntegration(t *testing.T) integrationEnv {
+	t.Helper()
+	token := os.Getenv("UPLOADER_IT_TOKEN")
+	if token == "" {
+		t.Skip("UPLOADER_IT_TOKEN not set")
+	}
+	chatID, err := strconv.ParseInt(os.Getenv("UPLOADER_IT_CHAT_ID"), 10, 64)
+	if err != nil {
+		t.Fatalf("UPLOADER_IT_CHAT_ID: %v", err)
+	}
+
+	// setupTransport wraps apiTransport, so put both back for the next test
+	oldBaseURL, oldTransport := apiBaseURL, apiTransport
+	t.Cleanup(func() { apiBaseURL, apiTransport = oldBaseURL, oldTransport })
+	apiBaseURL = os.Getenv("UPLOADER_IT_API_URL")
+	if apiBaseURL == "" {
+		apiBaseURL = "http://localhost:8081"
+	}
+	t.Setenv(stateDirEnv, t.TempDir())
+	t.Setenv(configEnv, filepath.Join(t.TempDir(), "config.json"))
+	if err := setupTransport(); err != nil {
+		t.Fatalf("setupTransport: %v", err)
+	}
+	return integrationEnv{token: token, chatID: chatID}
+}
+
+// options returns upload options for path with retries suited to a test.
+func (env integrationEnv) options(path string) uploadOptions {
+	return uploadOptions{
+		BotToken:   env.token,
+		JobID:      newJobID(),
+		ChatID:     env.chatID,
+		FilePath:   path,
+		Title:      "uploader integration test",
+		Performer:  "uploader",
+		Retries:    2,
+		RetryDelay: time.Second,
+	}
+}
+
+// cleanup deletes a test message once the test is over.
+func (env integrationEnv) cleanup(t *testing.T, chatID int64, messageID int) {
+	t.Cleanup(func() {
+		if _, err := callAPI(env.token, "deleteMessage", url.Values{
+			"chat_id":    {strconv.FormatInt(chatID, 10)},
+			"message_id": {strconv.Itoa(messageID)},
+		}); err != nil {
+			t.Logf("failed to delete message %d: %v", messageID, err)
+		}
+	})
+}
+
+// randomFile writes size random bytes to a file named name.
+func randomFile(t *testing.T, name string, size int64) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	buf := make([]byte, 1<<20)
+	for size > 0 {
+		n := int64(len(buf))
+		if n > size {
+			n = size
+		}
+		rand.Read(buf[:n])
+		if _, err := file.Write(buf[:n]); err != nil {
+			t.Fatal(err)
+		}
+		size -= n
+	}
+	return path
+}
+
+// silentWAV writes a mono 8 kHz 16-bit WAV file of the given length.
+func silentWAV(t *testing.T, seconds int) string {
+	t.Helper()
+	const rate = 8000
+	dataSize := uint32(seconds * rate * 2)
+	header := []interface{}{
+		[4]byte{'R', 'I', 'F', 'F'}, 36 + dataSize, [4]byte{'W', 'A', 'V', 'E'},
+		[4]byte{'f', 'm', 't', ' '}, uint32(16), uint16(1), uint16(1),
+		uint32(rate), uint32(rate * 2), uint16(2), uint16(16),
+		[4]byte{'d', 'a', 't', 'a'}, dataSize,
+	}
+	path := filepath.Join(t.TempDir(), "silence.wav")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	for _, field := range header {
+		if err := binary.Write(file, binary.LittleEndian, field); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := file.Write(make([]byte, dataSize)); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func checkUploaded(t *testing.T, result *uploadResult, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("upload failed: %v", err)
+	}
+	if result.MessageID == 0 || result.FileID == "" {
+		t.Fatalf("incomplete result: %+v", result)
+	}
+	if result.StoredSize != 0 && result.StoredSize != result.Size {
+		t.Errorf("server stored %d bytes, sent %d", result.StoredSize, result.Size)
+	}
+}
+
+func TestIntegrationDocument(t *testing.T) {
+	env := setupIntegration(t)
+	opts := env.options(randomFile(t, "document.bin", 256<<10))
+	opts.Caption = "document upload"
+
+	result, err := uploadFile(opts)
+	checkUploaded(t, result, err)
+	env.cleanup(t, result.ChatID, result.MessageID)
+
+	entries, err := readHistory()
+	if err != nil || len(entries) != 1 || entries[0].SHA256 != result.SHA256 {
+		t.Errorf("history not recorded: %v %+v", err, entries)
+	}
+}
+
+func TestIntegrationAudioWithThumbnail(t *testing.T) {
+	env := setupIntegration(t)
+	opts := env.options(silentWAV(t, 3))
+	opts.Duration = 3
+
+	thumbnail, err := autoThumbnail("badge", opts.FilePath)
+	if err != nil {
+		t.Fatalf("thumbnail: %v", err)
+	}
+	opts.ThumbnailPath = thumbnail
+
+	result, err := uploadFile(opts)
+	checkUploaded(t, result, err)
+	env.cleanup(t, result.ChatID, result.MessageID)
+}
+
+func TestIntegrationFanOut(t *testing.T) {
+	env := setupIntegration(t)
+	opts := env.options(randomFile(t, "fanout.bin", 64<<10))
+
+	result, err := uploadFile(opts)
+	checkUploaded(t, result, err)
+	env.cleanup(t, result.ChatID, result.MessageID)
+
+	copies := fanOut(opts, result, []int64{env.chatID}, 1, nil)
+	copied := copies[env.chatID]
+	if copied.Error != "" || copied.MessageID == 0 {
+		t.Fatalf("copy by file_id failed: %+v", copied)
+	}
+	env.cleanup(t, env.chatID, copied.MessageID)
+}
+
+// Larger than the 50 MB the cloud Bot API accepts, so this only passes
+// against a server in local mode.
+func TestIntegrationLargeFile(t *testing.T) {
+	if testing.Short() {
+		t.Skip("large upload skipped in -short mode")
+	}
+	env := setupIntegration(t)
+	opts := env.options(randomFile(t, "large.bin", 60<<20))
+
+	result, err := uploadFile(opts)
+	checkUploaded(t, result, err)
+	env.cleanup(t, result.ChatID, result.MessageID)
+	if result.Size != 60<<20 {
+		t.Errorf("sent %d bytes, want %d", result.Size, 60<<20)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+// newJobID returns a random ID identifying one upload run in the history,
+// dead letters, progress events and -json results.
+func newJobID() string {
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		// Practically impossible; fall back to something still unique enough
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// findJob returns the history entry for the upload made by jobID, not
+// counting its fan-out copies, or nil if the job hasn't posted. A staged
+// job's published message wins over its upload to the staging chat, which
+// is only returned, marked Staged, while the job is unpublished.
+func findJob(jobID string) (*historyEntry, error) {
+	entries, err := readHistory()
+	if err != nil {
+		return nil, err
+	}
+	var upload *historyEntry
+	for i := len(entries) - 1; i >= 0; i-- {
+		if entries[i].JobID != jobID {
+			continue
+		}
+		if entries[i].Published {
+			touchHistory(entries[i])
+			return &entries[i], nil
+		}
+		if upload == nil && !entries[i].Copy {
+			upload = &entries[i]
+		}
+	}
+	if upload != nil {
+		touchHistory(*upload)
+	}
+	return upload, nil
+}
+
+// runStatus implements the "status" subcommand. The exit code is 0 once the
+// job has posted, 1 if it failed for good and 2 if it is not known (still
+// running, or never existed) or staged but not yet published.
+func runStatus(args []string) int {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: uploader status <job_id>\n\n")
+		fmt.Fprintf(os.Stderr, "Exits 0 once the job has posted, 1 if it failed for good and 2 if it is unknown or still pending.\n")
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 1
+	}
+	jobID := fs.Arg(0)
+
+	entries, err := readHistory()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	var posted []historyEntry
+	for _, e := range entries {
+		if e.JobID == jobID {
+			posted = append(posted, e)
+		}
+	}
+	done := false
+	if len(posted) > 0 {
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "STATUS\tTIME\tCHAT\tMESSAGE\tFILE")
+		for _, e := range posted {
+			// A staged upload alone is not done: it still has to be published
+			status := "done"
+			if e.Staged {
+				status = "staged"
+			} else {
+				done = true
+			}
+			fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%s\n", status,
+				e.Time.Local().Format("2006-01-02 15:04:05"), e.ChatID, e.MessageID, e.File)
+		}
+		w.Flush()
+	}
+	if done {
+		return 0
+	}
+
+	letters, err := readDeadLetters()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	for _, letter := range letters {
+		if letter.Job.JobID == jobID {
+			fmt.Printf("failed\t%s\t%d attempt(s)\t%s\n",
+				letter.Time.Local().Format("2006-01-02 15:04:05"), letter.Attempts, letter.Error)
+			return 1
+		}
+	}
+
+	if len(posted) == 0 {
+		fmt.Printf("unknown\n")
+	}
+	return 2
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"os"
+)
+
+// ledgerKeyEnv holds an optional secret; with it set, ledger hashes are
+// HMACs, so only someone holding the key can produce a valid chain.
+const ledgerKeyEnv = "UPLOADER_LEDGER_KEY"
+
+// ledgerPath is the -ledger file every post is recorded in, if any.
+var ledgerPath string
+
+// ledgerRecord is one line of the ledger: a post, the hash of the previous
+// record and its own hash over both. Changing, dropping or reordering any
+// record breaks every hash after it.
+type ledgerRecord struct {
+	Seq int64 `json:"seq"`
+	historyEntry
+	Prev string `json:"prev"`
+	Hash string `json:"hash"`
+}
+
+func ledgerHasher() hash.Hash {
+	if key := os.Getenv(ledgerKeyEnv); key != "" {
+		return hmac.New(sha256.New, []byte(key))
+	}
+	return sha256.New()
+}
+
+// computeHash returns the hash of the record with the Hash field empty.
+func (r ledgerRecord) computeHash() string {
+	r.Hash = ""
+	data, _ := json.Marshal(r)
+	h := ledgerHasher()
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// readLedger returns the records of a ledger file, oldest first.
+func readLedger(path string) ([]ledgerRecord, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read ledger: %v", err)
+	}
+	defer file.Close()
+
+	var records []ledgerRecord
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		var record ledgerRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return nil, fmt.Errorf("ledger line %d is unreadable: %v", lineNo, err)
+		}
+		records = append(records, record)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read ledger: %v", err)
+	}
+	return records, nil
+}
+
+// ledgerHead is the last record of a ledger, kept in a "<ledger>.head"
+// file so an append needn't read the whole chain. Size is the ledger's
+// size once that record was written; a ledger of any other size was changed
+// behind the head's back and is read in full instead.
+type ledgerHead struct {
+	Seq  int64  `json:"seq"`
+	Hash string `json:"hash"`
+	Size int64  `json:"size"`
+}
+
+// readLedgerHead returns the sequence number and hash of the last record
+// of the ledger at path, from its head file when that is current.
+func readLedgerHead(path string) (int64, string, error) {
+	size := int64(0)
+	if info, err := os.Stat(path); err == nil {
+		size = info.Size()
+	} else if !os.IsNotExist(err) {
+		return 0, "", fmt.Errorf("failed to read ledger: %v", err)
+	}
+
+	var head ledgerHead
+	if data, err := os.ReadFile(path + ".head"); err == nil && json.Unmarshal(data, &head) == nil && head.Size == size {
+		return head.Seq, head.Hash, nil
+	}
+
+	records, err := readLedger(path)
+	if err != nil {
+		return 0, "", err
+	}
+	if n := len(records); n > 0 {
+		return records[n-1].Seq, records[n-1].Hash, nil
+	}
+	return 0, "", nil
+}
+
+// appendLedger chains entry onto the ledger, holding the ledger's lock so
+// concurrent uploaders can't fork the chain. Unlike the history, a ledger
+// that can't be read is an error rather than something to skip past.
+func appendLedger(entry historyEntry) error {
+	return withLock(ledgerPath, func() error {
+		seq, prev, err := readLedgerHead(ledgerPath)
+		if err != nil {
+			return err
+		}
+		record := ledgerRecord{Seq: seq + 1, historyEntry: entry, Prev: prev}
+		record.Hash = record.computeHash()
+
+		line, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		if err := appendLine(ledgerPath, line); err != nil {
+			return err
+		}
+
+		info, err := os.Stat(ledgerPath)
+		if err != nil {
+			return fmt.Errorf("failed to read ledger: %v", err)
+		}
+		head, _ := json.Marshal(ledgerHead{Seq: record.Seq, Hash: record.Hash, Size: info.Size()})
+		if err := writeFileAtomic(ledgerPath+".head", head, 0644); err != nil {
+			logf("Warning: failed to write ledger head: %v\n", err)
+		}
+		return nil
+	})
+}
+
+// verifyLedger checks every hash and link in the chain, returning the
+// number of records.
+func verifyLedger(path string) (int, error) {
+	records, err := readLedger(path)
+	if err != nil {
+		return 0, err
+	}
+	prev := ""
+	for i, record := range records {
+		if record.Seq != int64(i+1) {
+			return i, fmt.Errorf("record %d has sequence number %d", i+1, record.Seq)
+		}
+		if record.Prev != prev {
+			return i, fmt.Errorf("record %d does not link to the record before it", record.Seq)
+		}
+		if record.computeHash() != record.Hash {
+			return i, fmt.Errorf("record %d does not match its hash", record.Seq)
+		}
+		prev = record.Hash
+	}
+	return len(records), nil
+}
+
+// runLedger implements the "ledger" subcommand.
+func runLedger(args []string) int {
+	if len(args) < 2 || args[0] != "verify" {
+		fmt.Fprintf(os.Stderr, "Usage: uploader ledger verify <ledger_file>\n")
+		return 1
+	}
+	n, err := verifyLedger(args[1])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Ledger %s is broken after %d good record(s): %v\n", args[1], n, err)
+		return 1
+	}
+	fmt.Printf("Ledger %s is intact: %d record(s)\n", args[1], n)
+	return 0
+}
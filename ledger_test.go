@@ -0,0 +1,93 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeTestLedger chains n posts into a fresh ledger and returns its lines.
+func writeTestLedger(t *testing.T, n int) []string {
+	t.Helper()
+	ledgerPath = filepath.Join(t.TempDir(), "ledger.jsonl")
+	t.Cleanup(func() { ledgerPath = "" })
+	for i := 1; i <= n; i++ {
+		entry := historyEntry{Time: time.Unix(int64(1700000000+i), 0).UTC(), ChatID: -100123, MessageID: i, File: "song.flac"}
+		if err := appendLedger(entry); err != nil {
+			t.Fatalf("appendLedger: %v", err)
+		}
+	}
+	data, err := os.ReadFile(ledgerPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.SplitAfter(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+func TestVerifyLedger(t *testing.T) {
+	tests := []struct {
+		name   string
+		tamper func(lines []string) []string
+		good   int // records verified before the break, or all of them
+		broken bool
+	}{
+		{"intact", func(lines []string) []string { return lines }, 4, false},
+		{"edited record", func(lines []string) []string {
+			lines[1] = strings.Replace(lines[1], `"message_id":2`, `"message_id":20`, 1)
+			return lines
+		}, 1, true},
+		{"dropped record", func(lines []string) []string {
+			return append(lines[:2:2], lines[3:]...)
+		}, 2, true},
+		{"swapped records", func(lines []string) []string {
+			lines[1], lines[2] = lines[2], lines[1]
+			return lines
+		}, 1, true},
+		{"dropped first record", func(lines []string) []string { return lines[1:] }, 0, true},
+		{"truncated tail", func(lines []string) []string { return lines[:3] }, 3, false},
+	}
+	for _, tt := range tests {
+		lines := writeTestLedger(t, 4)
+		path := ledgerPath
+		if err := os.WriteFile(path, []byte(strings.Join(tt.tamper(lines), "")), 0644); err != nil {
+			t.Fatal(err)
+		}
+		n, err := verifyLedger(path)
+		if (err != nil) != tt.broken || n != tt.good {
+			t.Errorf("%s: verifyLedger = %d, %v; want %d good, broken %v", tt.name, n, err, tt.good, tt.broken)
+		}
+	}
+}
+
+func TestAppendLedgerWithoutHead(t *testing.T) {
+	writeTestLedger(t, 2)
+
+	// A missing or stale head is rebuilt from the ledger itself
+	os.Remove(ledgerPath + ".head")
+	if err := appendLedger(historyEntry{MessageID: 3}); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(ledgerPath+".head", []byte(`{"seq":1,"hash":"stale","size":1}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := appendLedger(historyEntry{MessageID: 4}); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := verifyLedger(ledgerPath); err != nil || n != 4 {
+		t.Errorf("verifyLedger = %d, %v; want 4 good records", n, err)
+	}
+}
+
+func TestVerifyLedgerKey(t *testing.T) {
+	t.Setenv(ledgerKeyEnv, "secret")
+	writeTestLedger(t, 3)
+	if n, err := verifyLedger(ledgerPath); err != nil || n != 3 {
+		t.Errorf("with the key: verifyLedger = %d, %v; want 3 good records", n, err)
+	}
+	t.Setenv(ledgerKeyEnv, "other")
+	if _, err := verifyLedger(ledgerPath); err == nil {
+		t.Errorf("a ledger verified under the wrong key")
+	}
+}
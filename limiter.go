@@ -0,0 +1,139 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Process-wide limits applied to every bot token without its own entry in
+// the config file.
+var (
+	maxConcurrent     int
+	requestsPerSecond float64
+)
+
+// tokenLimits caps what one bot token may have in flight.
+type tokenLimits struct {
+	// MaxConcurrent is the most requests open at once, uploads included
+	MaxConcurrent int `json:"max_concurrent,omitempty"`
+
+	// RequestsPerSecond spaces out request starts; 0 means unlimited
+	RequestsPerSecond float64 `json:"requests_per_second,omitempty"`
+}
+
+// tokenLimiter enforces one token's limits.
+type tokenLimiter struct {
+	slots    chan struct{} // nil when concurrency is unlimited
+	interval time.Duration
+
+	mu   sync.Mutex
+	next time.Time // earliest start of the next request
+}
+
+func newTokenLimiter(limits tokenLimits) *tokenLimiter {
+	l := &tokenLimiter{}
+	if limits.MaxConcurrent > 0 {
+		l.slots = make(chan struct{}, limits.MaxConcurrent)
+	}
+	if limits.RequestsPerSecond > 0 {
+		l.interval = time.Duration(float64(time.Second) / limits.RequestsPerSecond)
+	}
+	return l
+}
+
+// acquire blocks until a request may start, returning the function that
+// ends it, or the request's context error if it is cancelled first.
+func (l *tokenLimiter) acquire(req *http.Request) (func(), error) {
+	release := func() {}
+	if l.slots != nil {
+		select {
+		case l.slots <- struct{}{}:
+			release = func() { <-l.slots }
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+
+	if l.interval > 0 {
+		l.mu.Lock()
+		now := time.Now()
+		start := l.next
+		if start.Before(now) {
+			start = now
+		}
+		l.next = start.Add(l.interval)
+		l.mu.Unlock()
+
+		if wait := time.Until(start); wait > 0 {
+			timer := time.NewTimer(wait)
+			defer timer.Stop()
+			select {
+			case <-timer.C:
+			case <-req.Context().Done():
+				release()
+				return nil, req.Context().Err()
+			}
+		}
+	}
+	return release, nil
+}
+
+// limitTransport holds Bot API requests to their token's limits, so every
+// upload, copy and API call the process makes with a token counts together.
+type limitTransport struct {
+	base   http.RoundTripper
+	limits map[string]tokenLimits // by bot ID
+	global tokenLimits
+
+	mu       sync.Mutex
+	limiters map[string]*tokenLimiter
+}
+
+// botID returns the numeric bot ID from the token in a Bot API URL path,
+// e.g. "123" for /bot123:ABC/sendDocument. Limits are keyed by it so the
+// config file doesn't have to hold secrets.
+func botID(path string) string {
+	for _, segment := range strings.Split(path, "/") {
+		if token := strings.TrimPrefix(segment, "bot"); token != segment {
+			id, _, _ := strings.Cut(token, ":")
+			return id
+		}
+	}
+	return ""
+}
+
+func (t *limitTransport) limiter(id string) *tokenLimiter {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if l, ok := t.limiters[id]; ok {
+		return l
+	}
+	limits, ok := t.limits[id]
+	if !ok {
+		limits = t.global
+	}
+	l := newTokenLimiter(limits)
+	t.limiters[id] = l
+	return l
+}
+
+func (t *limitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	id := botID(req.URL.Path)
+	if id == "" {
+		return t.base.RoundTrip(req)
+	}
+	release, err := t.limiter(id).acquire(req)
+	if err != nil {
+		// A RoundTripper must close the body even when it fails
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+	// The slot is held while the request body is sent, which is the part
+	// of an upload that takes long
+	defer release()
+	return t.base.RoundTrip(req)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// countingTransport stands in for the network, recording how many requests
+// it has open at once.
+type countingTransport struct {
+	hold time.Duration
+
+	mu      sync.Mutex
+	open    int
+	maxOpen int
+	starts  []time.Time
+}
+
+func (c *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	c.mu.Lock()
+	c.open++
+	if c.open > c.maxOpen {
+		c.maxOpen = c.open
+	}
+	c.starts = append(c.starts, time.Now())
+	c.mu.Unlock()
+
+	time.Sleep(c.hold)
+
+	c.mu.Lock()
+	c.open--
+	c.mu.Unlock()
+	return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+}
+
+func runRequests(t *testing.T, transport http.RoundTripper, urls []string) {
+	t.Helper()
+	var wg sync.WaitGroup
+	for _, url := range urls {
+		wg.Add(1)
+		go func(url string) {
+			defer wg.Done()
+			req, _ := http.NewRequest(http.MethodPost, url, nil)
+			if _, err := transport.RoundTrip(req); err != nil {
+				t.Error(err)
+			}
+		}(url)
+	}
+	wg.Wait()
+}
+
+func TestLimitTransportConcurrency(t *testing.T) {
+	tests := []struct {
+		limits  tokenLimits
+		urls    []string
+		maxOpen int
+	}{
+		{tokenLimits{MaxConcurrent: 2}, repeat("http://x/bot1:A/sendDocument", 6), 2},
+		{tokenLimits{MaxConcurrent: 1}, repeat("http://x/bot1:A/sendDocument", 4), 1},
+		// Unlimited
+		{tokenLimits{}, repeat("http://x/bot1:A/sendDocument", 4), 4},
+		// Each token has its own limiter
+		{tokenLimits{MaxConcurrent: 1}, append(repeat("http://x/bot1:A/getMe", 2), repeat("http://x/bot2:B/getMe", 2)...), 2},
+		// Requests without a token aren't limited
+		{tokenLimits{MaxConcurrent: 1}, repeat("http://x/file/other", 3), 3},
+	}
+	for _, tt := range tests {
+		base := &countingTransport{hold: 50 * time.Millisecond}
+		transport := &limitTransport{base: base, global: tt.limits, limiters: map[string]*tokenLimiter{}}
+		runRequests(t, transport, tt.urls)
+		if base.maxOpen != tt.maxOpen {
+			t.Errorf("%+v with %d requests: %d open at once, want %d", tt.limits, len(tt.urls), base.maxOpen, tt.maxOpen)
+		}
+	}
+}
+
+func TestLimitTransportRate(t *testing.T) {
+	base := &countingTransport{}
+	transport := &limitTransport{
+		base:     base,
+		global:   tokenLimits{RequestsPerSecond: 20},
+		limits:   map[string]tokenLimits{"2": {RequestsPerSecond: 1000}},
+		limiters: map[string]*tokenLimiter{},
+	}
+	runRequests(t, transport, repeat("http://x/bot1:A/getMe", 5))
+	if spread := base.starts[4].Sub(base.starts[0]); spread < 180*time.Millisecond {
+		t.Errorf("5 requests at 20/s started within %v, want at least 200ms", spread)
+	}
+
+	// A token's own entry overrides the global limit
+	base.starts = nil
+	runRequests(t, transport, repeat("http://x/bot2:B/getMe", 5))
+	if spread := base.starts[4].Sub(base.starts[0]); spread > 100*time.Millisecond {
+		t.Errorf("5 requests at 1000/s took %v to start", spread)
+	}
+}
+
+type closeRecorder struct {
+	io.Reader
+	closed bool
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestLimitTransportClosesBodyOnCancel(t *testing.T) {
+	transport := &limitTransport{
+		base:     &countingTransport{},
+		global:   tokenLimits{MaxConcurrent: 1},
+		limiters: map[string]*tokenLimiter{},
+	}
+	// Take the only slot so the next request has to wait
+	release, err := transport.limiter("1").acquire(limitedRequest(context.Background(), nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	body := &closeRecorder{Reader: strings.NewReader("data")}
+	if _, err := transport.RoundTrip(limitedRequest(ctx, body)); err == nil {
+		t.Fatal("request went through with no free slot")
+	}
+	if !body.closed {
+		t.Error("body of the cancelled request was not closed")
+	}
+}
+
+func limitedRequest(ctx context.Context, body io.ReadCloser) *http.Request {
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, "http://x/bot1:A/sendDocument", nil)
+	if body != nil {
+		req.Body = body
+	}
+	return req
+}
+
+func repeat(s string, n int) []string {
+	out := make([]string, n)
+	for i := range out {
+		out[i] = s
+	}
+	return out
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+var procLockFileEx = syscall.NewLazyDLL("kernel32.dll").NewProc("LockFileEx")
+
+const lockfileExclusiveLock = 0x2
+
+// lockFile blocks until it holds an exclusive lock on file. The lock is
+// released when the file is closed, including by the process dying.
+func lockFile(file *os.File) error {
+	var overlapped syscall.Overlapped
+	ok, _, err := procLockFileEx.Call(file.Fd(), lockfileExclusiveLock, 0, 1, 0, uintptr(unsafe.Pointer(&overlapped)))
+	if ok == 0 {
+		return err
+	}
+	return nil
+}
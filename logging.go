@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// logFile receives a timestamped copy of every diagnostic when --log-file
+// is set; stderr output is unchanged either way.
+var logFile io.Writer
+
+// quiet keeps progress messages and warnings off stderr (--quiet); the log
+// file still gets them.
+var quiet bool
+
+// logf writes a diagnostic message to stderr and, if configured, the log file.
+func logf(format string, args ...interface{}) {
+	writeLog(!quiet, format, args...)
+}
+
+// errorf is logf for the error that makes the run fail, which --quiet
+// still shows.
+func errorf(format string, args ...interface{}) {
+	writeLog(true, format, args...)
+}
+
+func writeLog(toStderr bool, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	if toStderr {
+		fmt.Fprint(os.Stderr, msg)
+	}
+
+	if logFile != nil {
+		fmt.Fprintf(logFile, "%s %s", time.Now().Format(time.RFC3339), msg)
+	}
+}
+
+// rotatingFile is an append-only log file that rotates itself once it grows
+// past maxSize bytes or its last write falls into an earlier rotation
+// interval, keeping at most maxBackups old files (path.1 is the newest).
+type rotatingFile struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	interval   time.Duration
+	maxBackups int
+
+	file    *os.File
+	size    int64
+	modTime time.Time
+}
+
+func openRotatingFile(path string, maxSize int64, interval time.Duration, maxBackups int) (*rotatingFile, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create log directory: %v", err)
+	}
+
+	r := &rotatingFile{
+		path:       path,
+		maxSize:    maxSize,
+		interval:   interval,
+		maxBackups: maxBackups,
+	}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	file, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open log file: %v", err)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to stat log file: %v", err)
+	}
+
+	r.file = file
+	r.size = info.Size()
+	r.modTime = info.ModTime()
+	if r.size == 0 {
+		r.modTime = time.Now()
+	}
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	if r.shouldRotate(now, int64(len(p))) {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	r.modTime = now
+	return n, err
+}
+
+func (r *rotatingFile) shouldRotate(now time.Time, incoming int64) bool {
+	if r.size == 0 {
+		return false
+	}
+	if r.maxSize > 0 && r.size+incoming > r.maxSize {
+		return true
+	}
+	// Time-based rotation compares interval buckets rather than process
+	// uptime, so it also works for short-lived CLI invocations.
+	if r.interval > 0 && !now.Truncate(r.interval).Equal(r.modTime.Truncate(r.interval)) {
+		return true
+	}
+	return false
+}
+
+func (r *rotatingFile) rotate() error {
+	if err := r.file.Close(); err != nil {
+		return fmt.Errorf("failed to close log file: %v", err)
+	}
+
+	if r.maxBackups > 0 {
+		// Shift path.N-1 -> path.N, dropping whatever falls off the end
+		os.Remove(fmt.Sprintf("%s.%d", r.path, r.maxBackups))
+		for i := r.maxBackups - 1; i >= 1; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+		}
+		if err := os.Rename(r.path, r.path+".1"); err != nil {
+			return fmt.Errorf("failed to rotate log file: %v", err)
+		}
+	} else if err := os.Remove(r.path); err != nil {
+		return fmt.Errorf("failed to rotate log file: %v", err)
+	}
+
+	return r.open()
+}
+
+func (r *rotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.file.Close()
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// logFiles returns the contents of the log and its backups by suffix.
+func logFiles(t *testing.T, path string) map[string]string {
+	t.Helper()
+	matches, _ := filepath.Glob(path + "*")
+	files := make(map[string]string)
+	for _, match := range matches {
+		data, err := os.ReadFile(match)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[strings.TrimPrefix(match, path)] = string(data)
+	}
+	return files
+}
+
+func TestRotatingFileSize(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxSize    int64
+		maxBackups int
+		existing   string
+		writes     []string
+		want       map[string]string
+	}{
+		{"below limit", 10, 2, "", []string{"12345", "12345"}, map[string]string{"": "1234512345"}},
+		{"shifts backups", 10, 2, "", []string{"12345", "12345", "abc", "defghijk", "x"},
+			map[string]string{"": "defghijkx", ".1": "abc", ".2": "1234512345"}},
+		{"drops the oldest", 3, 1, "", []string{"aaa", "bbb", "ccc"},
+			map[string]string{"": "ccc", ".1": "bbb"}},
+		{"no backups", 4, 0, "", []string{"abcd", "ef"}, map[string]string{"": "ef"}},
+		// An oversized write to an empty file has nowhere better to go
+		{"oversized write", 4, 2, "", []string{"abcdefgh"}, map[string]string{"": "abcdefgh"}},
+		// A file left by an earlier run counts towards the limit
+		{"existing file", 10, 2, "12345678", []string{"abc"},
+			map[string]string{"": "abc", ".1": "12345678"}},
+		{"unlimited", 0, 2, "", []string{"12345", "12345", "12345"}, map[string]string{"": "123451234512345"}},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "logs", "uploader.log")
+		if tt.existing != "" {
+			os.MkdirAll(filepath.Dir(path), 0755)
+			if err := os.WriteFile(path, []byte(tt.existing), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		r, err := openRotatingFile(path, tt.maxSize, 0, tt.maxBackups)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		for _, w := range tt.writes {
+			if _, err := r.Write([]byte(w)); err != nil {
+				t.Errorf("%s: write %q: %v", tt.name, w, err)
+			}
+		}
+		r.Close()
+		if got := logFiles(t, path); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: files %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRotatingFileInterval(t *testing.T) {
+	tests := []struct {
+		name    string
+		lastAge time.Duration // how long before now the previous write was
+		rotated bool
+	}{
+		{"same interval", 0, false},
+		{"earlier interval", 25 * time.Hour, true},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "uploader.log")
+		r, err := openRotatingFile(path, 0, 24*time.Hour, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Write([]byte("old"))
+		r.modTime = r.modTime.Add(-tt.lastAge)
+		r.Write([]byte("new"))
+		r.Close()
+
+		want := map[string]string{"": "oldnew"}
+		if tt.rotated {
+			want = map[string]string{"": "new", ".1": "old"}
+		}
+		if got := logFiles(t, path); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: files %q, want %q", tt.name, got, want)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// Metadata cleanup rules selectable with -clean-metadata.
+const (
+	cleanSpace = "space" // trim and collapse whitespace
+	cleanCaps  = "caps"  // title-case values written entirely in capitals
+	cleanNoise = "noise" // strip tags such as "(Official Audio)"
+)
+
+// noisePatterns match the video-site leftovers that commonly end up in tags.
+var noisePatterns = []string{
+	`(?i)\s*[(\[]\s*(official\s+)?(music\s+)?(audio|video|lyric\s+video|lyrics?|visuali[sz]er)\s*[)\]]`,
+	`(?i)\s*[(\[]\s*official\s*[)\]]`,
+	`(?i)\s*[(\[]\s*(hq|hd|4k|explicit)\s*[)\]]`,
+}
+
+// metadataCleaner tidies titles and performers before they are sent.
+type metadataCleaner struct {
+	space, caps bool
+	strip       []*regexp.Regexp
+}
+
+// newMetadataCleaner builds a cleaner from a comma-separated rule list
+// ("all" for every rule) and extra patterns to strip.
+func newMetadataCleaner(rules string, extra []string) (*metadataCleaner, error) {
+	c := &metadataCleaner{}
+	var patterns []string
+	for _, rule := range splitList(rules) {
+		switch rule {
+		case "all":
+			c.space, c.caps = true, true
+			patterns = append(patterns, noisePatterns...)
+		case cleanSpace:
+			c.space = true
+		case cleanCaps:
+			c.caps = true
+		case cleanNoise:
+			patterns = append(patterns, noisePatterns...)
+		default:
+			return nil, fmt.Errorf("unknown cleanup rule %q", rule)
+		}
+	}
+	patterns = append(patterns, extra...)
+
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %v", pattern, err)
+		}
+		c.strip = append(c.strip, re)
+	}
+	return c, nil
+}
+
+func (c *metadataCleaner) clean(value string) string {
+	for _, re := range c.strip {
+		value = re.ReplaceAllString(value, "")
+	}
+	if c.space || len(c.strip) > 0 {
+		// Stripping leaves gaps behind, so it implies collapsing them
+		value = strings.Join(strings.Fields(value), " ")
+	}
+	if c.caps && shouting(value) {
+		value = titleCase(value)
+	}
+	return value
+}
+
+// shouting reports whether value is written entirely in capitals. Single
+// words are left alone, since those are usually acronyms like ABBA.
+func shouting(value string) bool {
+	letters := 0
+	for _, r := range value {
+		if unicode.IsLower(r) {
+			return false
+		}
+		if unicode.IsLetter(r) {
+			letters++
+		}
+	}
+	return letters > 3 && len(strings.Fields(value)) > 1
+}
+
+// titleCase capitalises the first letter of every word and lowercases the
+// rest. Apostrophes don't start a word, so DON'T becomes Don't.
+func titleCase(value string) string {
+	var b strings.Builder
+	wordStart := true
+	for _, r := range value {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if wordStart {
+				b.WriteRune(unicode.ToUpper(r))
+			} else {
+				b.WriteRune(unicode.ToLower(r))
+			}
+			wordStart = false
+			continue
+		}
+		b.WriteRune(r)
+		wordStart = r != '\'' && r != '’'
+	}
+	return b.String()
+}
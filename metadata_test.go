@@ -0,0 +1,63 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMetadataCleaner(t *testing.T) {
+	tests := []struct {
+		rules string
+		extra []string
+		in    string
+		want  string
+	}{
+		{"", nil, "  Song   Title ", "  Song   Title "},
+		{"space", nil, "  Song \t  Title ", "Song Title"},
+		{"noise", nil, "Song (Official Music Video)", "Song"},
+		{"noise", nil, "Song [Lyric Video] (HQ)", "Song"},
+		{"noise", nil, "Song (official) [Explicit] - Live", "Song - Live"},
+		{"noise", nil, "Song (Visualiser)", "Song"},
+		{"noise", nil, "Song (Remix)", "Song (Remix)"},
+		// Stripping collapses the gap it leaves even without "space"
+		{"", []string{`\s*- Topic$`}, "Artist  Name - Topic", "Artist Name"},
+		{"caps", nil, "DON'T STOP ME NOW", "Don't Stop Me Now"},
+		{"caps", nil, "SONG NO 2", "Song No 2"},
+		{"caps", nil, "Mixed CASE Title", "Mixed CASE Title"},
+		// A single word or a short one stays: usually an acronym
+		{"caps", nil, "ABBA", "ABBA"},
+		{"caps", nil, "AC/DC", "AC/DC"},
+		{"caps", nil, "U 2", "U 2"},
+		{"caps", nil, "ABBA GOLD", "Abba Gold"},
+		{"caps", nil, "ДИДЮЛЯ ЛУЧШЕЕ", "Дидюля Лучшее"},
+		// Noise is stripped first, so what is left counts as a single word
+		{"all", nil, "  QUEEN   (Official Audio) ", "QUEEN"},
+		{"all", nil, "  BOHEMIAN RHAPSODY   (Official Audio) ", "Bohemian Rhapsody"},
+	}
+	for _, tt := range tests {
+		c, err := newMetadataCleaner(tt.rules, tt.extra)
+		if err != nil {
+			t.Fatalf("newMetadataCleaner(%q, %q): %v", tt.rules, tt.extra, err)
+		}
+		if got := c.clean(tt.in); got != tt.want {
+			t.Errorf("rules %q %q: clean(%q) = %q, want %q", tt.rules, tt.extra, tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestMetadataCleanerErrors(t *testing.T) {
+	tests := []struct {
+		rules string
+		extra []string
+		err   string
+	}{
+		{"space,shout", nil, `unknown cleanup rule "shout"`},
+		{"", []string{"(unclosed"}, `invalid pattern "(unclosed"`},
+	}
+	for _, tt := range tests {
+		_, err := newMetadataCleaner(tt.rules, tt.extra)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("newMetadataCleaner(%q, %q) = %v, want %q", tt.rules, tt.extra, err, tt.err)
+		}
+	}
+}
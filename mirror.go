@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// missingMessage reports whether err is copyMessage saying the source
+// message doesn't exist (deleted, a gap in the IDs, or a service message).
+func missingMessage(err error) bool {
+	var apiErr *TelegramError
+	return errors.As(err, &apiErr) && apiErr.IsBadRequest() &&
+		(strings.Contains(apiErr.Description, "message to copy not found") ||
+			strings.Contains(apiErr.Description, "message can't be copied"))
+}
+
+// copyMessage re-posts one message with copyMessage, which keeps the media
+// (by file_id) and caption but drops the "Forwarded from" header. fields
+// adds optional parameters such as the reply target.
+func copyMessage(botToken string, from, to int64, messageID int, fields map[string]string, gate *floodGate) (int, error) {
+	params := url.Values{
+		"chat_id":      {strconv.FormatInt(to, 10)},
+		"from_chat_id": {strconv.FormatInt(from, 10)},
+		"message_id":   {strconv.Itoa(messageID)},
+	}
+	for key, value := range fields {
+		params.Set(key, value)
+	}
+	for {
+		gate.wait()
+		raw, err := callAPI(botToken, "copyMessage", params)
+		var retryErr *retryableError
+		if errors.As(err, &retryErr) && retryErr.after > 0 {
+			gate.pause(retryErr.after)
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		var copied struct {
+			MessageID int `json:"message_id"`
+		}
+		if err := json.Unmarshal(raw, &copied); err != nil {
+			return 0, fmt.Errorf("failed to decode response: %v", err)
+		}
+		return copied.MessageID, nil
+	}
+}
+
+// runMirror implements the "mirror" subcommand. The Bot API can't list a
+// chat's history, so the messages to copy are either a message ID range or,
+// by default, the uploads recorded in the history for the source chat.
+func runMirror(args []string) int {
+	fs := flag.NewFlagSet("mirror", flag.ExitOnError)
+	addConnectionFlags(fs)
+	first := fs.Int("from", 0, "first message ID to copy (with -to; default: the uploads in the history)")
+	last := fs.Int("to", 0, "last message ID to copy")
+	delay := fs.Duration("delay", time.Second, "pause between copies")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: uploader mirror [flags] <bot_token> <source_chat> <destination_chat>\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() < 3 {
+		fs.Usage()
+		return 1
+	}
+	if err := setupTransport(); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid connection settings: %v\n", err)
+		return 1
+	}
+	if (*first == 0) != (*last == 0) || *first > *last {
+		fmt.Fprintf(os.Stderr, "-from and -to must be given together, -from first\n")
+		return 1
+	}
+
+	botToken := fs.Arg(0)
+	cfg, err := loadConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	source, err := resolveChatID(cfg, fs.Arg(1))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid source chat: %v\n", err)
+		return 1
+	}
+	destination, err := resolveChatID(cfg, fs.Arg(2))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid destination chat: %v\n", err)
+		return 1
+	}
+
+	// Source message ID -> what the history knows about it
+	known := make(map[int]historyEntry)
+	entries, err := readHistory()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	for _, e := range entries {
+		if e.ChatID == source {
+			known[e.MessageID] = e
+		}
+	}
+
+	var ids []int
+	if *first != 0 {
+		for id := *first; id <= *last; id++ {
+			ids = append(ids, id)
+		}
+	} else {
+		for id := range known {
+			ids = append(ids, id)
+		}
+		sort.Ints(ids)
+		if len(ids) == 0 {
+			fmt.Fprintf(os.Stderr, "The history has no uploads to chat %d; pass -from and -to\n", source)
+			return 1
+		}
+	}
+
+	gate := &floodGate{}
+	copied, missing, failed := 0, 0, 0
+	for i, id := range ids {
+		if i > 0 {
+			time.Sleep(*delay)
+		}
+		messageID, err := copyMessage(botToken, source, destination, id, nil, gate)
+		if missingMessage(err) {
+			missing++
+			continue
+		}
+		if err != nil {
+			logf("Copying message %d failed: %v\n", id, err)
+			failed++
+			continue
+		}
+		copied++
+
+		// Only messages the history knows carry anything worth recording
+		entry, ok := known[id]
+		if !ok {
+			continue
+		}
+		entry.Time = time.Now().UTC()
+		entry.ChatID = destination
+		entry.MessageID = messageID
+		entry.Copy = true
+		entry.Imported = false
+		entry.JobID = ""
+		if err := appendHistory(entry); err != nil {
+			logf("Warning: failed to record upload history: %v\n", err)
+		}
+	}
+
+	fmt.Printf("Copied %d message(s) from %d to %d (%d missing, %d failed)\n", copied, source, destination, missing, failed)
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
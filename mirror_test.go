@@ -0,0 +1,28 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestMissingMessage(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{errors.New("message to copy not found"), false},
+		{&TelegramError{Code: 400, Description: "Bad Request: message to copy not found"}, true},
+		{&TelegramError{Code: 400, Description: "Bad Request: message can't be copied"}, true},
+		{fmt.Errorf("copying: %w", &TelegramError{Code: 400, Description: "Bad Request: message to copy not found"}), true},
+		{&TelegramError{Code: 400, Description: "Bad Request: chat not found"}, false},
+		{&TelegramError{Code: 403, Description: "Forbidden: message to copy not found"}, false},
+		{&retryableError{err: &TelegramError{Code: 429, Description: "Too Many Requests: retry after 5"}}, false},
+	}
+	for _, tt := range tests {
+		if got := missingMessage(tt.err); got != tt.want {
+			t.Errorf("missingMessage(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+)
+
+// sendPermission returns the ChatPermissions field that gates sending opts.
+func sendPermission(opts uploadOptions) string {
+	switch endpoint, _ := sendTarget(opts); endpoint {
+	case "sendAudio":
+		return "can_send_audios"
+	case "sendVideo":
+		return "can_send_videos"
+	case "sendPaidMedia":
+		if paidMediaKind(opts.FilePath) == "photo" {
+			return "can_send_photos"
+		}
+		return "can_send_videos"
+	}
+	return "can_send_documents"
+}
+
+// checkPermissions asks the Bot API whether the bot may post opts to chatID,
+// so a missing right fails before a long upload instead of after it. With a
+// topic the chat must be a forum, and creating the topic with createTopic
+// needs can_manage_topics. The Bot API can't tell whether a topic is closed,
+// so that still only shows when posting.
+func checkPermissions(opts uploadOptions, chatID int64, topic string, createTopic bool) error {
+	raw, err := callAPI(opts.BotToken, "getMe", nil)
+	if err != nil {
+		return fmt.Errorf("failed to look up the bot: %v", err)
+	}
+	var me struct {
+		ID int64 `json:"id"`
+	}
+	if err := json.Unmarshal(raw, &me); err != nil {
+		return fmt.Errorf("failed to decode getMe: %v", err)
+	}
+
+	chat := strconv.FormatInt(chatID, 10)
+	raw, err = callAPI(opts.BotToken, "getChat", url.Values{"chat_id": {chat}})
+	if err != nil {
+		return fmt.Errorf("bot cannot access chat %d: %v", chatID, err)
+	}
+	var info struct {
+		Type        string                 `json:"type"`
+		IsForum     bool                   `json:"is_forum"`
+		Permissions map[string]interface{} `json:"permissions"`
+	}
+	if err := json.Unmarshal(raw, &info); err != nil {
+		return fmt.Errorf("failed to decode getChat: %v", err)
+	}
+	if topic != "" && !info.IsForum {
+		return fmt.Errorf("chat %d is not a forum, so it has no topic %q", chatID, topic)
+	}
+	// A thread ID or a topic already in the cache needs no creating
+	needsTopic := false
+	if topic != "" && createTopic {
+		_, err := resolveTopic(opts.BotToken, chatID, topic, false)
+		needsTopic = err != nil
+	}
+	if info.Type == "private" {
+		// Private chats have no member rights; getChat already proved access
+		return nil
+	}
+
+	raw, err = callAPI(opts.BotToken, "getChatMember", url.Values{
+		"chat_id": {chat},
+		"user_id": {strconv.FormatInt(me.ID, 10)},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to look up the bot in chat %d: %v", chatID, err)
+	}
+	var member map[string]interface{}
+	if err := json.Unmarshal(raw, &member); err != nil {
+		return fmt.Errorf("failed to decode getChatMember: %v", err)
+	}
+
+	permission := sendPermission(opts)
+	status, _ := member["status"].(string)
+	switch status {
+	case "creator":
+		return nil
+	case "administrator":
+		if info.Type == "channel" && member["can_post_messages"] != true {
+			return fmt.Errorf("bot lacks permission to post in channel %d (grant it \"Post messages\")", chatID)
+		}
+		if needsTopic && member["can_manage_topics"] != true {
+			return fmt.Errorf("bot lacks permission to create topic %q in chat %d (grant it \"Manage topics\")", topic, chatID)
+		}
+		return nil
+	case "left", "kicked":
+		return fmt.Errorf("bot is not a member of chat %d (status %q)", chatID, status)
+	case "restricted":
+		if member[permission] == false {
+			return fmt.Errorf("bot lacks permission to send this file to chat %d (%s is off for the bot)", chatID, permission)
+		}
+		if needsTopic && member["can_manage_topics"] == false {
+			return fmt.Errorf("bot lacks permission to create topic %q in chat %d (can_manage_topics is off for the bot)", topic, chatID)
+		}
+		return nil
+	}
+
+	if info.Type == "channel" {
+		return fmt.Errorf("bot lacks permission to post in channel %d (it must be an administrator)", chatID)
+	}
+	if info.Permissions[permission] == false {
+		return fmt.Errorf("bot lacks permission to send this file to chat %d (%s is off for members)", chatID, permission)
+	}
+	if needsTopic && info.Permissions["can_manage_topics"] == false {
+		return fmt.Errorf("bot lacks permission to create topic %q in chat %d (can_manage_topics is off for members)", topic, chatID)
+	}
+	return nil
+}
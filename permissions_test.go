@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCheckPermissionsTopics(t *testing.T) {
+	var chat, member string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/getMe"):
+			fmt.Fprint(w, `{"ok":true,"result":{"id":42}}`)
+		case strings.HasSuffix(r.URL.Path, "/getChat"):
+			fmt.Fprintf(w, `{"ok":true,"result":%s}`, chat)
+		case strings.HasSuffix(r.URL.Path, "/getChatMember"):
+			fmt.Fprintf(w, `{"ok":true,"result":%s}`, member)
+		}
+	}))
+	defer server.Close()
+	apiBaseURL = server.URL
+	t.Cleanup(func() { apiBaseURL = defaultAPIURL })
+	t.Setenv(stateDirEnv, t.TempDir())
+	if err := rememberTopic(-100, "known", 5); err != nil {
+		t.Fatal(err)
+	}
+
+	const (
+		forum    = `{"type":"supergroup","is_forum":true,"permissions":{"can_send_documents":true,"can_manage_topics":false}}`
+		group    = `{"type":"supergroup","permissions":{"can_send_documents":true}}`
+		admin    = `{"status":"administrator","can_manage_topics":false}`
+		manager  = `{"status":"administrator","can_manage_topics":true}`
+		plain    = `{"status":"member"}`
+		creator  = `{"status":"creator"}`
+		muted    = `{"status":"restricted","can_send_documents":true,"can_manage_topics":false}`
+		noRights = "lacks permission to create topic"
+	)
+	tests := []struct {
+		chat, member string
+		topic        string
+		create       bool
+		err          string // substring; "" for no error
+	}{
+		{group, plain, "", false, ""},
+		{group, plain, "7", false, "is not a forum"},
+		{forum, plain, "7", false, ""},
+		// Posting into an existing topic needs no topic rights
+		{forum, admin, "News", false, ""},
+		{forum, admin, "News", true, noRights},
+		{forum, manager, "News", true, ""},
+		{forum, creator, "News", true, ""},
+		{forum, plain, "News", true, noRights},
+		{forum, muted, "News", true, noRights},
+		// Thread IDs and cached names are never created
+		{forum, plain, "7", true, ""},
+		{forum, plain, "known", true, ""},
+	}
+	for _, tt := range tests {
+		chat, member = tt.chat, tt.member
+		opts := uploadOptions{BotToken: "1:x", FilePath: "notes.bin"}
+		err := checkPermissions(opts, -100, tt.topic, tt.create)
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("%s %s topic %q create=%v: %v", tt.chat, tt.member, tt.topic, tt.create, err)
+		case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+			t.Errorf("%s %s topic %q create=%v: got %v, want %q", tt.chat, tt.member, tt.topic, tt.create, err, tt.err)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// runPreview implements the "preview" subcommand: it renders the caption an
+// upload would get, resolves its entities and checks its length, without
+// contacting Telegram.
+func runPreview(args []string) int {
+	fs := flag.NewFlagSet("preview", flag.ExitOnError)
+	captionTemplate := fs.String("caption", "", "caption template, as for an upload")
+	parseMode := fs.String("parse-mode", "", "parse mode: HTML, MarkdownV2 or Markdown")
+	captionOverflow := fs.String("caption-overflow", overflowTruncate, "what to do with captions over 1024 characters: truncate, followup or error")
+	asDocument := fs.Bool("as-document", false, "preview for a file sent as a document")
+	chat := fs.String("chat", "", "apply the config's defaults for this chat ID or alias")
+	fs.StringVar(&captionLocale, "caption-locale", "en", "locale for humanSize in -caption templates")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: uploader preview [flags] <file_path> <title> <performer> [duration]\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() < 3 {
+		fs.Usage()
+		return 1
+	}
+	if _, ok := numberLocales[captionLocale]; !ok {
+		fmt.Fprintf(os.Stderr, "Invalid -caption-locale %q\n", captionLocale)
+		return 1
+	}
+
+	opts := uploadOptions{
+		FilePath:   fs.Arg(0),
+		Title:      fs.Arg(1),
+		Performer:  fs.Arg(2),
+		AsDocument: *asDocument,
+		ParseMode:  *parseMode,
+	}
+	if fs.NArg() > 3 {
+		duration, err := strconv.Atoi(fs.Arg(3))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid duration: %v\n", err)
+			return 1
+		}
+		opts.Duration = duration
+	}
+
+	setFlags := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { setFlags[f.Name] = true })
+	if *chat != "" {
+		cfg, err := loadConfig()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return 1
+		}
+		chatID, err := resolveChatID(cfg, *chat)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid -chat: %v\n", err)
+			return 1
+		}
+		defaults := cfg.defaultsFor(chatID)
+		if !setFlags["parse-mode"] {
+			opts.ParseMode = defaults.ParseMode
+		}
+		if !setFlags["caption"] {
+			*captionTemplate = defaults.Caption
+		}
+	}
+
+	if *captionTemplate != "" {
+		var err error
+		if opts.Caption, err = renderCaption(*captionTemplate, opts); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid -caption: %v\n", err)
+			return 1
+		}
+	}
+	raw := messageCaption(opts)
+	if raw == "" {
+		fmt.Println("No caption: audio shows the title and performer in the player.")
+		return 0
+	}
+
+	caption, followUps, err := fitCaption(raw, *captionOverflow, opts.ParseMode)
+	if err != nil {
+		fmt.Printf("Caption: the upload would fail: %v\n", err)
+		return 1
+	}
+	if plain, _, err := parseEntities(raw, opts.ParseMode); err == nil && utf16Len(plain) > captionLimit {
+		switch *captionOverflow {
+		case overflowFollowUp:
+			fmt.Printf("Caption is %d characters; the rest goes into %d follow-up message(s)\n\n", utf16Len(plain), len(followUps))
+		case overflowError:
+			fmt.Printf("Caption is %d characters and is sent as is\n\n", utf16Len(plain))
+		default:
+			fmt.Printf("Caption is %d characters and is truncated\n\n", utf16Len(plain))
+		}
+	}
+
+	ok := previewText("Caption", caption, opts.ParseMode, captionLimit)
+	for i, text := range followUps {
+		ok = previewText(fmt.Sprintf("Follow-up %d", i+1), text, opts.ParseMode, messageLimit) && ok
+	}
+	if !ok {
+		return 1
+	}
+	return 0
+}
+
+// previewText prints text as Telegram would display it, with its entities,
+// reporting whether it would be accepted.
+func previewText(label, text, parseMode string, limit int) bool {
+	plain, entities, err := parseEntities(text, parseMode)
+	if err != nil {
+		fmt.Printf("%s: Telegram would reject it: can't parse entities: %v\n\n", label, err)
+		return false
+	}
+	n := utf16Len(strings.TrimSpace(plain))
+	fmt.Printf("%s (%d of %d characters):\n%s\n", label, n, limit, plain)
+	if len(entities) > 0 {
+		fmt.Println()
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ENTITY\tOFFSET\tLENGTH\tTEXT\tDETAIL")
+		units := utf16Units(plain)
+		for _, entity := range entities {
+			detail := entity.URL + entity.Language + entity.EmojiID
+			fmt.Fprintf(w, "%s\t%d\t%d\t%q\t%s\n", entity.Type, entity.Offset, entity.Length,
+				utf16Slice(units, entity.Offset, entity.Length), detail)
+		}
+		w.Flush()
+	}
+	fmt.Println()
+	if n > limit {
+		fmt.Printf("%s: Telegram would reject it: %d characters is over the %d limit\n\n", label, n, limit)
+		return false
+	}
+	return true
+}
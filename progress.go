@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// progressEvent is one line of -progress json output.
+type progressEvent struct {
+	Event string `json:"event"`
+	JobID string `json:"job_id"`
+	File  string `json:"file"`
+	Sent  int64  `json:"sent"`
+	Total int64  `json:"total"`
+	Speed int64  `json:"speed"`         // bytes per second this attempt
+	ETA   int64  `json:"eta,omitempty"` // seconds left at the current speed
+}
+
+// progressReporter writes upload progress as JSON lines for wrappers that
+// re-render it, at most once per interval plus once at the end of the file.
+type progressReporter struct {
+	out      io.Writer
+	jobID    string
+	file     string
+	interval time.Duration
+
+	mu       sync.Mutex
+	start    time.Time
+	lastSent int64
+	lastEmit time.Time
+	finished bool // the final event of this attempt is out
+}
+
+// newProgressReporter opens the output for -progress-fd; 1 and 2 are stdout
+// and stderr, anything else must be a descriptor the parent left open.
+func newProgressReporter(fd int, jobID, file string, interval time.Duration) (*progressReporter, error) {
+	var out io.Writer
+	switch fd {
+	case 1:
+		out = os.Stdout
+	case 2:
+		out = os.Stderr
+	default:
+		if fd < 0 {
+			return nil, fmt.Errorf("invalid file descriptor %d", fd)
+		}
+		f := os.NewFile(uintptr(fd), "progress")
+		// NewFile doesn't check the descriptor; without this every event
+		// would fail to write with nothing said
+		if _, err := f.Stat(); err != nil {
+			return nil, fmt.Errorf("descriptor %d is not open", fd)
+		}
+		out = f
+	}
+	return &progressReporter{out: out, jobID: jobID, file: file, interval: interval}, nil
+}
+
+func (p *progressReporter) update(sent, total int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	if p.start.IsZero() || sent < p.lastSent {
+		// First read, or a retry started over
+		p.start = now
+		p.lastEmit = time.Time{}
+		p.finished = false
+	}
+	p.lastSent = sent
+
+	if p.finished || sent < total && now.Sub(p.lastEmit) < p.interval {
+		return
+	}
+	p.lastEmit = now
+	p.finished = sent >= total
+
+	event := progressEvent{Event: "progress", JobID: p.jobID, File: p.file, Sent: sent, Total: total}
+	if elapsed := now.Sub(p.start).Seconds(); elapsed > 0 {
+		speed := float64(sent) / elapsed
+		event.Speed = int64(speed)
+		if speed > 0 {
+			event.ETA = int64(float64(total-sent)/speed + 0.5)
+		}
+	}
+	line, _ := json.Marshal(event)
+	p.out.Write(append(line, '\n'))
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// gatewayMaxDelay caps the wait between retries of a gateway error.
+const gatewayMaxDelay = 30 * time.Second
+
+// Telegram answers 502 and 504 in bursts while its front ends hiccup. Those
+// codes are retried on their own budget: for up to gatewayRetryWindow after
+// the first one, however many -retries are left, so a platform blip doesn't
+// eat the retries meant for real failures.
+var (
+	gatewayCodes       = statusSet{502: true, 504: true}
+	gatewayRetryWindow time.Duration
+)
+
+// statusSet is a flag holding a comma-separated list of HTTP status codes.
+type statusSet map[int]bool
+
+func (s statusSet) String() string {
+	var codes []string
+	for code := range s {
+		codes = append(codes, strconv.Itoa(code))
+	}
+	sort.Strings(codes)
+	return strings.Join(codes, ",")
+}
+
+func (s statusSet) Set(value string) error {
+	for code := range s {
+		delete(s, code)
+	}
+	for _, field := range splitList(value) {
+		code, err := strconv.Atoi(field)
+		if err != nil || code < 100 || code > 599 {
+			return fmt.Errorf("invalid HTTP status %q", field)
+		}
+		s[code] = true
+	}
+	return nil
+}
+
+// isGatewayError reports whether err is a retryable failure whose HTTP
+// status is one of the gateway codes.
+func isGatewayError(err *retryableError) bool {
+	return err != nil && gatewayCodes[err.status]
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+// runSpeedtest implements the "speedtest" subcommand: it uploads a synthetic
+// document of the given size, reports how long the bytes took to leave this
+// host versus how long the server took to answer afterwards, and deletes
+// the test message again.
+func runSpeedtest(args []string) int {
+	fs := flag.NewFlagSet("speedtest", flag.ExitOnError)
+	addConnectionFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: uploader speedtest [connection flags] <bot_token> <chat_id> [size_mib]\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if err := setupTransport(); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid connection settings: %v\n", err)
+		return 1
+	}
+
+	if fs.NArg() < 2 {
+		fs.Usage()
+		return 1
+	}
+
+	botToken := fs.Arg(0)
+	chatID, err := strconv.ParseInt(fs.Arg(1), 10, 64)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid chat ID: %v\n", err)
+		return 1
+	}
+
+	sizeMiB := 10
+	if fs.NArg() > 2 {
+		sizeMiB, err = strconv.Atoi(fs.Arg(2))
+		if err != nil || sizeMiB <= 0 {
+			fmt.Fprintf(os.Stderr, "Invalid size_mib: %s\n", fs.Arg(2))
+			return 1
+		}
+	}
+
+	// Round-trip latency baseline
+	start := time.Now()
+	if _, err := callAPI(botToken, "getMe", nil); err != nil {
+		fmt.Fprintf(os.Stderr, "getMe failed: %v\n", err)
+		return 1
+	}
+	fmt.Printf("Latency (getMe):  %v\n", time.Since(start).Round(time.Millisecond))
+
+	result, err := speedtestUpload(botToken, chatID, int64(sizeMiB)<<20)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Upload failed: %v\n", err)
+		return 1
+	}
+
+	sent := result.sent.Sub(result.start)
+	total := result.done.Sub(result.start)
+	fmt.Printf("Upload size:      %d MiB\n", sizeMiB)
+	fmt.Printf("Transfer time:    %v (%.2f MiB/s, %.1f Mbit/s)\n",
+		sent.Round(time.Millisecond), float64(sizeMiB)/sent.Seconds(), float64(sizeMiB)*8.388608/sent.Seconds())
+	fmt.Printf("Server response:  %v after the last byte\n", result.done.Sub(result.sent).Round(time.Millisecond))
+	fmt.Printf("Total:            %v (%.2f MiB/s effective)\n", total.Round(time.Millisecond), float64(sizeMiB)/total.Seconds())
+
+	if _, err := callAPI(botToken, "deleteMessage", url.Values{
+		"chat_id":    {strconv.FormatInt(chatID, 10)},
+		"message_id": {strconv.Itoa(result.messageID)},
+	}); err != nil {
+		logf("Warning: failed to delete test message %d: %v\n", result.messageID, err)
+	}
+
+	return 0
+}
+
+type speedtestResult struct {
+	messageID         int
+	start, sent, done time.Time
+}
+
+// timedReader records when its underlying reader reaches EOF.
+type timedReader struct {
+	io.Reader
+	eof time.Time
+}
+
+func (r *timedReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if err == io.EOF && r.eof.IsZero() {
+		r.eof = time.Now()
+	}
+	return n, err
+}
+
+func speedtestUpload(botToken string, chatID int64, size int64) (*speedtestResult, error) {
+	pr, pw := io.Pipe()
+	multipartWriter := multipart.NewWriter(pw)
+
+	go func() {
+		var writeErr error
+		defer func() {
+			if closeErr := multipartWriter.Close(); closeErr != nil && writeErr == nil {
+				writeErr = closeErr
+			}
+			pw.CloseWithError(writeErr)
+		}()
+
+		if writeErr = multipartWriter.WriteField("chat_id", strconv.FormatInt(chatID, 10)); writeErr != nil {
+			return
+		}
+		if writeErr = multipartWriter.WriteField("disable_notification", "true"); writeErr != nil {
+			return
+		}
+
+		part, err := multipartWriter.CreateFormFile("document", "speedtest.bin")
+		if err != nil {
+			writeErr = err
+			return
+		}
+
+		// Random bytes, so no proxy on the way can compress the payload
+		_, writeErr = io.CopyN(part, rand.New(rand.NewSource(time.Now().UnixNano())), size)
+	}()
+
+	body := &timedReader{Reader: pr}
+	req, err := http.NewRequest("POST", methodURL(botToken, "sendDocument"), body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("Content-Type", multipartWriter.FormDataContentType())
+
+	client := httpClient(10 * time.Minute)
+
+	result := &speedtestResult{start: time.Now()}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %v", err)
+	}
+	defer resp.Body.Close()
+	result.done = time.Now()
+	result.sent = body.eof
+	if result.sent.IsZero() {
+		result.sent = result.done
+	}
+
+	var response TelegramResponse
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %v", err)
+	}
+	if err := json.Unmarshal(raw, &response); err != nil {
+		return nil, decodeError(resp, raw, err)
+	}
+	if !response.OK {
+		return nil, &TelegramError{Code: response.ErrorCode, Description: response.Description, Parameters: response.Parameters}
+	}
+
+	result.messageID = response.Result.MessageID
+	return result, nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// verifyStaged checks that a file uploaded to the staging chat arrived
+// intact before it goes public.
+func verifyStaged(uploaded *uploadResult) error {
+	if uploaded.FileID == "" {
+		return fmt.Errorf("staged message %d carries no file", uploaded.MessageID)
+	}
+	if uploaded.StoredSize != 0 && uploaded.StoredSize != uploaded.Size {
+		return fmt.Errorf("staged message %d holds %d bytes, but %d were sent",
+			uploaded.MessageID, uploaded.StoredSize, uploaded.Size)
+	}
+	return nil
+}
+
+// stagedUpload rebuilds the upload result of a staged history entry, so a
+// rerun can publish it without uploading the file again.
+func stagedUpload(entry *historyEntry) *uploadResult {
+	return &uploadResult{
+		ChatID:    entry.ChatID,
+		MessageID: entry.MessageID,
+		FileID:    entry.FileID,
+		SHA256:    entry.SHA256,
+		Size:      entry.Size,
+	}
+}
+
+// publishStaged copies a verified upload from the staging chat to
+// opts.PublishChatID, replying to opts.PublishReplyTo and in
+// opts.PublishThreadID there, and records it as the job's published message.
+func publishStaged(opts uploadOptions, staged *uploadResult) (int, error) {
+	if err := verifyStaged(staged); err != nil {
+		return 0, fmt.Errorf("not publishing: %v", err)
+	}
+	chatID := opts.PublishChatID
+
+	fields := make(map[string]string)
+	if opts.PublishReplyTo != 0 {
+		fields = replyFields(opts.PublishReplyTo, opts.AllowSendingWithoutReply)
+	}
+	if opts.PublishThreadID != 0 {
+		fields["message_thread_id"] = strconv.Itoa(opts.PublishThreadID)
+	}
+	if opts.ProtectContent {
+		fields["protect_content"] = "true"
+	}
+	messageID, err := copyMessage(opts.BotToken, staged.ChatID, chatID, staged.MessageID, fields, &floodGate{})
+	if err != nil {
+		return 0, fmt.Errorf("failed to publish staged message %d: %v", staged.MessageID, err)
+	}
+
+	if err := writeTimestamp(chatTimestampFile(chatID)); err != nil {
+		logf("Warning: failed to write last upload timestamp for chat %d: %v\n", chatID, err)
+	}
+	if err := appendHistory(historyEntry{
+		Time:      time.Now().UTC(),
+		ChatID:    chatID,
+		MessageID: messageID,
+		File:      opts.FilePath,
+		FileName:  uploadFilename(opts),
+		Title:     opts.Title,
+		Performer: opts.Performer,
+		Size:      staged.Size,
+		SHA256:    staged.SHA256,
+		FileID:    staged.FileID,
+		Copy:      true,
+		JobID:     opts.JobID,
+		Published: true,
+	}); err != nil {
+		logf("Warning: failed to record upload history: %v\n", err)
+	}
+	return messageID, nil
+}
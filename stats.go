@@ -0,0 +1,214 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// dailyCap limits the bytes uploaded per local calendar day; 0 means
+// unlimited. Resends by file_id don't count, as they transfer nothing.
+var dailyCap int64
+
+// parseSize parses a byte count with an optional K, M, G or T suffix
+// (binary multiples), e.g. "500M".
+func parseSize(value string) (int64, error) {
+	number := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(value)), "B")
+	shift := 0
+	if n := len(number); n > 0 {
+		switch number[n-1] {
+		case 'K':
+			shift = 10
+		case 'M':
+			shift = 20
+		case 'G':
+			shift = 30
+		case 'T':
+			shift = 40
+		}
+		if shift > 0 {
+			number = number[:n-1]
+		}
+	}
+	n, err := strconv.ParseFloat(number, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	return int64(n * float64(int64(1)<<shift)), nil
+}
+
+// formatSize renders a byte count with a binary unit.
+func formatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit && exp < 3; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGT"[exp])
+}
+
+// bytesSent is what an upload cost on the wire.
+func (e historyEntry) bytesSent() int64 {
+	if e.Copy || e.Imported {
+		return 0
+	}
+	return e.Size
+}
+
+// startOfDay returns local midnight at the start of t's day.
+func startOfDay(t time.Time) time.Time {
+	year, month, day := t.Local().Date()
+	return time.Date(year, month, day, 0, 0, 0, 0, time.Local)
+}
+
+// todayUsage sums the bytes uploaded since local midnight.
+func todayUsage(entries []historyEntry) int64 {
+	today := startOfDay(time.Now())
+	var used int64
+	for _, e := range entries {
+		if !e.Time.Before(today) {
+			used += e.bytesSent()
+		}
+	}
+	return used
+}
+
+// waitForDailyCap pauses until uploading path fits into today's allowance,
+// which may mean waiting for the day to roll over.
+func waitForDailyCap(path string) error {
+	if dailyCap <= 0 {
+		return nil
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if info.Size() > dailyCap {
+		return fmt.Errorf("file is %s, more than the daily cap of %s", formatSize(info.Size()), formatSize(dailyCap))
+	}
+
+	for {
+		entries, err := readHistory()
+		if err != nil {
+			return err
+		}
+		used := todayUsage(entries)
+		if used+info.Size() <= dailyCap {
+			return nil
+		}
+
+		tomorrow := startOfDay(time.Now()).AddDate(0, 0, 1)
+		logf("Daily cap of %s reached (%s used today); pausing until %s\n",
+			formatSize(dailyCap), formatSize(used), tomorrow.Format("2006-01-02 15:04"))
+		time.Sleep(time.Until(tomorrow))
+	}
+}
+
+// runStats implements the "stats" subcommand.
+func runStats(args []string) int {
+	fs := flag.NewFlagSet("stats", flag.ExitOnError)
+	since := fs.String("since", "30d", "only count uploads within this age (e.g. 7d) or since this date (YYYY-MM-DD)")
+	by := fs.String("by", "day", "group by day, chat or day,chat")
+	chat := fs.Int64("chat", 0, "only count uploads to this chat ID")
+	fs.Parse(args)
+
+	filter := historyFilter{chatID: *chat}
+	if age, err := parseAge(*since); err == nil {
+		filter.since = time.Now().Add(-age)
+	} else if filter.since, err = parseHistoryTime(*since); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid -since: %v\n", err)
+		return 1
+	}
+
+	var byDay, byChat bool
+	for _, key := range splitList(*by) {
+		switch key {
+		case "day":
+			byDay = true
+		case "chat":
+			byChat = true
+		default:
+			fmt.Fprintf(os.Stderr, "Invalid -by %q\n", key)
+			return 1
+		}
+	}
+
+	entries, err := readHistory()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+
+	type group struct {
+		day     string
+		chatID  int64
+		uploads int
+		bytes   int64
+	}
+	groups := make(map[string]*group)
+	var keys []string
+	total := group{}
+	for _, e := range entries {
+		if !filter.match(e) {
+			continue
+		}
+		var g group
+		if byDay {
+			g.day = e.Time.Local().Format("2006-01-02")
+		}
+		if byChat {
+			g.chatID = e.ChatID
+		}
+		key := fmt.Sprintf("%s/%d", g.day, g.chatID)
+		if groups[key] == nil {
+			groups[key] = &g
+			keys = append(keys, key)
+		}
+		groups[key].uploads++
+		groups[key].bytes += e.bytesSent()
+		total.uploads++
+		total.bytes += e.bytesSent()
+	}
+	sort.Strings(keys)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	var header []string
+	if byDay {
+		header = append(header, "DAY")
+	}
+	if byChat {
+		header = append(header, "CHAT")
+	}
+	fmt.Fprintln(w, strings.Join(append(header, "UPLOADS", "BYTES", "SIZE"), "\t"))
+	for _, key := range keys {
+		g := groups[key]
+		var row []string
+		if byDay {
+			row = append(row, g.day)
+		}
+		if byChat {
+			row = append(row, strconv.FormatInt(g.chatID, 10))
+		}
+		fmt.Fprintln(w, strings.Join(append(row, strconv.Itoa(g.uploads),
+			strconv.FormatInt(g.bytes, 10), formatSize(g.bytes)), "\t"))
+	}
+	row := make([]string, len(header))
+	if len(row) > 0 {
+		row[0] = "TOTAL"
+	}
+	fmt.Fprintln(w, strings.Join(append(row, strconv.Itoa(total.uploads),
+		strconv.FormatInt(total.bytes, 10), formatSize(total.bytes)), "\t"))
+	w.Flush()
+
+	fmt.Printf("\nToday: %s uploaded\n", formatSize(todayUsage(entries)))
+	return 0
+}
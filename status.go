@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// statusInterval is how often the status message is edited. Telegram rate
+// limits edits, so this stays well above once a second.
+const statusInterval = 5 * time.Second
+
+// progressReader reports how many bytes have been read so far.
+type progressReader struct {
+	r      io.Reader
+	sent   int64
+	total  int64
+	report func(sent, total int64)
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.sent += int64(n)
+	p.report(p.sent, p.total)
+	return n, err
+}
+
+// statusMessage is a text message in the target chat showing how far a slow
+// upload has got. It is only posted once an upload has run for a full
+// interval, and deleted when the upload is done.
+type statusMessage struct {
+	opts  uploadOptions
+	label string
+
+	mu          sync.Mutex
+	sent, total int64
+
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+// startStatus begins watching upload progress; pass update as the upload's
+// progress callback and call finish once it returns.
+func startStatus(opts uploadOptions) *statusMessage {
+	label := opts.Title
+	if label == "" {
+		label = filepath.Base(opts.FilePath)
+	}
+	s := &statusMessage{
+		opts:    opts,
+		label:   label,
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+func (s *statusMessage) update(sent, total int64) {
+	s.mu.Lock()
+	s.sent, s.total = sent, total
+	s.mu.Unlock()
+}
+
+func (s *statusMessage) run() {
+	defer close(s.stopped)
+
+	ticker := time.NewTicker(statusInterval)
+	defer ticker.Stop()
+
+	messageID := 0
+	lastText := ""
+	for {
+		select {
+		case <-s.done:
+			if messageID != 0 {
+				if _, err := callAPI(s.opts.BotToken, "deleteMessage", url.Values{
+					"chat_id":    {strconv.FormatInt(s.opts.ChatID, 10)},
+					"message_id": {strconv.Itoa(messageID)},
+				}); err != nil {
+					logf("Warning: failed to delete status message: %v\n", err)
+				}
+			}
+			return
+		case <-ticker.C:
+		}
+
+		s.mu.Lock()
+		sent, total := s.sent, s.total
+		s.mu.Unlock()
+		if total <= 0 {
+			// Still waiting out the delay, or not reading the file yet
+			continue
+		}
+
+		text := fmt.Sprintf("Uploading %s — %d%%", s.label, sent*100/total)
+		if text == lastText {
+			continue
+		}
+
+		params := url.Values{
+			"chat_id": {strconv.FormatInt(s.opts.ChatID, 10)},
+			"text":    {text},
+		}
+		method := "sendMessage"
+		if messageID != 0 {
+			method = "editMessageText"
+			params.Set("message_id", strconv.Itoa(messageID))
+		} else if s.opts.ThreadID != 0 {
+			params.Set("message_thread_id", strconv.Itoa(s.opts.ThreadID))
+		}
+		raw, err := callAPI(s.opts.BotToken, method, params)
+		if err != nil {
+			logf("Warning: failed to update status message: %v\n", err)
+			continue
+		}
+		lastText = text
+
+		if messageID == 0 {
+			var message struct {
+				MessageID int `json:"message_id"`
+			}
+			if err := json.Unmarshal(raw, &message); err == nil {
+				messageID = message.MessageID
+			}
+		}
+	}
+}
+
+// finish deletes the status message, if one was posted.
+func (s *statusMessage) finish() {
+	close(s.done)
+	<-s.stopped
+}
+
+// chatActionInterval is how often the chat action is renewed; Telegram
+// shows one for five seconds or until a message arrives.
+const chatActionInterval = 4 * time.Second
+
+// chatAction returns the sendChatAction action matching how opts is sent.
+// There is no audio action, so audio shows as a document like in clients.
+func chatAction(opts uploadOptions) string {
+	endpoint, _ := sendTarget(opts)
+	switch {
+	case endpoint == "sendVideo":
+		return "upload_video"
+	case endpoint == "sendPaidMedia" && paidMediaKind(opts.FilePath) == "photo":
+		return "upload_photo"
+	case endpoint == "sendPaidMedia":
+		return "upload_video"
+	}
+	return "upload_document"
+}
+
+// startChatAction keeps the "sending file..." indicator showing in the
+// target chat until the returned function is called. Failures only cost the
+// indicator, so they are not reported.
+func startChatAction(opts uploadOptions) func() {
+	params := url.Values{
+		"chat_id": {strconv.FormatInt(opts.ChatID, 10)},
+		"action":  {chatAction(opts)},
+	}
+	if opts.ThreadID != 0 {
+		params.Set("message_thread_id", strconv.Itoa(opts.ThreadID))
+	}
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(chatActionInterval)
+		defer ticker.Stop()
+		for {
+			callAPI(opts.BotToken, "sendChatAction", params)
+			select {
+			case <-ticker.C:
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() { close(done) }
+}
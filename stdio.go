@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// stdioJob is one request line of the stdio protocol. Chats may be given
+// as numbers or as strings naming an alias or "self".
+type stdioJob struct {
+	ID               string            `json:"id"`
+	BotToken         string            `json:"bot_token"`
+	Chat             json.RawMessage   `json:"chat_id"`
+	AlsoTo           []json.RawMessage `json:"also_to"`
+	File             string            `json:"file"`
+	Title            string            `json:"title"`
+	Performer        string            `json:"performer"`
+	Duration         int               `json:"duration"`
+	ReplyToMessageID int               `json:"reply_to_message_id"`
+	Thumbnail        string            `json:"thumbnail"`
+	Caption          string            `json:"caption"`
+	ParseMode        string            `json:"parse_mode"`
+	DelaySeconds     *int              `json:"delay_seconds"`
+	ProtectContent   *bool             `json:"protect_content"`
+	Topic            string            `json:"topic"`
+	AsDocument       bool              `json:"as_document"`
+	Retries          *int              `json:"retries"`
+}
+
+// chatArg turns a JSON number or string into a chat argument for
+// resolveChatID.
+func chatArg(raw json.RawMessage) string {
+	var name string
+	if json.Unmarshal(raw, &name) == nil {
+		return name
+	}
+	return strings.TrimSpace(string(raw))
+}
+
+// runStdio implements the "stdio" subcommand: a long-lived process reading
+// one JSON job per line on stdin and writing one JSON result per
+// destination chat on stdout, so other programs can drive uploads without
+// spawning a process each. Diagnostics go to stderr.
+func runStdio(args []string) int {
+	fs := flag.NewFlagSet("stdio", flag.ExitOnError)
+	addConnectionFlags(fs)
+	concurrency := fs.Int("concurrency", 1, "jobs to run at once; results may then arrive out of order, matched by job_id")
+	retries := fs.Int("retries", 0, "extra attempts for jobs that don't set retries")
+	retryDelay := fs.Duration("retry-delay", 5*time.Second, "wait before the first retry, doubling after each attempt")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: uploader stdio [flags] [bot_token]\n\n")
+		fmt.Fprintf(os.Stderr, "Reads jobs from stdin, one JSON object per line, e.g.\n")
+		fmt.Fprintf(os.Stderr, "  {\"id\": \"42\", \"chat_id\": -100123, \"file\": \"song.flac\", \"title\": \"Song\", \"performer\": \"Artist\"}\n")
+		fmt.Fprintf(os.Stderr, "and writes a JSON result line per chat to stdout, with the id as job_id.\n")
+		fmt.Fprintf(os.Stderr, "bot_token is the default for jobs without a \"bot_token\".\n\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *concurrency < 1 {
+		fmt.Fprintf(os.Stderr, "-concurrency must be at least 1\n")
+		return 1
+	}
+	if err := setupTransport(); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid connection settings: %v\n", err)
+		return 1
+	}
+	if err := checkStateDir(); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	cfg, err := loadConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+
+	// Results from concurrent jobs must not interleave
+	var outMu sync.Mutex
+	emit := func(record resultRecord) {
+		line, _ := json.Marshal(record)
+		outMu.Lock()
+		fmt.Println(string(line))
+		outMu.Unlock()
+	}
+
+	slots := make(chan struct{}, *concurrency)
+	var wg sync.WaitGroup
+	scanner := bufio.NewScanner(os.Stdin)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		var job stdioJob
+		if err := json.Unmarshal([]byte(line), &job); err != nil {
+			emit(resultRecord{Error: fmt.Sprintf("invalid job: %v", err)})
+			continue
+		}
+		if job.BotToken == "" {
+			job.BotToken = fs.Arg(0)
+		}
+		if job.Retries == nil {
+			job.Retries = retries
+		}
+
+		slots <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() { <-slots; wg.Done() }()
+			runStdioJob(cfg, job, *retryDelay, emit)
+		}()
+	}
+	wg.Wait()
+	if err := scanner.Err(); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read jobs: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// runStdioJob uploads one job and emits its results, applying the target
+// chat's config defaults like a command-line upload does.
+func runStdioJob(cfg *config, job stdioJob, retryDelay time.Duration, emit func(resultRecord)) {
+	fail := func(chatID int64, err error) {
+		errorf("Job %s failed: %v\n", job.ID, err)
+		emit(resultRecord{JobID: job.ID, ChatID: chatID, File: job.File, Error: err.Error()})
+	}
+	if job.BotToken == "" || job.File == "" || len(job.Chat) == 0 {
+		fail(0, fmt.Errorf("bot_token, chat_id and file are required"))
+		return
+	}
+
+	// A job ID that already posted gets its earlier result back
+	if job.ID != "" {
+		existing, err := findJob(job.ID)
+		if err != nil {
+			fail(0, err)
+			return
+		}
+		if existing != nil {
+			emit(resultRecord{JobID: job.ID, ChatID: existing.ChatID, File: job.File,
+				MessageID: existing.MessageID, FileID: existing.FileID})
+			return
+		}
+	} else {
+		job.ID = newJobID()
+	}
+
+	chatID, err := resolveChatID(cfg, chatArg(job.Chat))
+	if err != nil {
+		fail(0, fmt.Errorf("invalid chat_id: %v", err))
+		return
+	}
+	var alsoTo []int64
+	for _, raw := range job.AlsoTo {
+		target, err := resolveChatID(cfg, chatArg(raw))
+		if err != nil {
+			fail(chatID, fmt.Errorf("invalid also_to: %v", err))
+			return
+		}
+		alsoTo = append(alsoTo, target)
+	}
+
+	defaults := cfg.defaultsFor(chatID)
+	opts := uploadOptions{
+		BotToken:         job.BotToken,
+		JobID:            job.ID,
+		ChatID:           chatID,
+		FilePath:         job.File,
+		Title:            job.Title,
+		Performer:        job.Performer,
+		Duration:         job.Duration,
+		ReplyToMessageID: job.ReplyToMessageID,
+		ThumbnailPath:    job.Thumbnail,
+		ParseMode:        defaults.ParseMode,
+		DelaySeconds:     defaults.DelaySeconds,
+		Retries:          *job.Retries,
+		RetryDelay:       retryDelay,
+		CaptionOverflow:  overflowTruncate,
+		AsDocument:       job.AsDocument,
+		ProtectContent:   defaults.ProtectContent,
+	}
+	if job.ParseMode != "" {
+		opts.ParseMode = job.ParseMode
+	}
+	if job.DelaySeconds != nil {
+		opts.DelaySeconds = *job.DelaySeconds
+	}
+	if job.ProtectContent != nil {
+		opts.ProtectContent = *job.ProtectContent
+	}
+	caption, topic := defaults.Caption, defaults.Topic
+	if job.Caption != "" {
+		caption = job.Caption
+	}
+	if job.Topic != "" {
+		topic = job.Topic
+	}
+	if caption != "" {
+		if opts.Caption, err = renderCaption(caption, opts); err != nil {
+			fail(chatID, fmt.Errorf("invalid caption: %v", err))
+			return
+		}
+	}
+	if topic != "" {
+		if opts.ThreadID, err = resolveTopic(opts.BotToken, chatID, topic, false); err != nil {
+			fail(chatID, err)
+			return
+		}
+	}
+
+	result, err := uploadFile(opts)
+	if err != nil {
+		fail(chatID, err)
+		return
+	}
+	emit(resultRecord{JobID: job.ID, ChatID: result.ChatID, File: job.File, MessageID: result.MessageID,
+		FileID: result.FileID, FileUniqueID: result.FileUniqueID, FileSize: result.StoredSize,
+		Date: result.Date, Transcoded: result.Transcoded})
+
+	if len(alsoTo) > 0 {
+		opts.ChatID = result.ChatID
+		// As many at once as -fan-out-concurrency allows by default
+		fanOut(opts, result, alsoTo, 4, func(target int64, r fanOutResult) {
+			emit(resultRecord{JobID: job.ID, ChatID: target, File: job.File, MessageID: r.MessageID, Error: r.Error})
+		})
+	}
+}
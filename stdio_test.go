@@ -0,0 +1,26 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestChatArg(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want string
+	}{
+		{`123`, "123"},
+		{`-1001234567890`, "-1001234567890"},
+		{` 42 `, "42"},
+		{`"-100123"`, "-100123"},
+		{`"news"`, "news"},
+		{`"self"`, "self"},
+		{`"@channel"`, "@channel"},
+	}
+	for _, tt := range tests {
+		if got := chatArg(json.RawMessage(tt.raw)); got != tt.want {
+			t.Errorf("chatArg(%s) = %q, want %q", tt.raw, got, tt.want)
+		}
+	}
+}
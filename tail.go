@@ -0,0 +1,58 @@
+package main
+
+import (
+	"io"
+	"os"
+	"time"
+)
+
+// tailDoneSuffix names the marker a writer can create next to a file being
+// tailed to say it is complete, e.g. recording.ts.done.
+const tailDoneSuffix = ".done"
+
+// tailReader reads a file that is still being written. At the end of the
+// data so far it waits for more instead of returning EOF, until the file
+// has not grown for idle or the done marker appears.
+type tailReader struct {
+	file       *os.File
+	path       string
+	idle       time.Duration
+	lastGrowth time.Time
+}
+
+func newTailReader(file *os.File, path string, idle time.Duration) *tailReader {
+	return &tailReader{file: file, path: path, idle: idle, lastGrowth: time.Now()}
+}
+
+func (t *tailReader) Read(b []byte) (int, error) {
+	poll := t.idle / 4
+	if poll > time.Second {
+		poll = time.Second
+	}
+	for {
+		n, err := t.file.Read(b)
+		if n > 0 {
+			t.lastGrowth = time.Now()
+			if err == io.EOF {
+				err = nil
+			}
+			return n, err
+		}
+		if err != io.EOF {
+			return 0, err
+		}
+
+		if _, statErr := os.Stat(t.path + tailDoneSuffix); statErr == nil {
+			// The writer is done; anything it wrote before saying so is
+			// already visible, so one more read drains it
+			if n, err = t.file.Read(b); n > 0 {
+				return n, nil
+			}
+			return 0, io.EOF
+		}
+		if time.Since(t.lastGrowth) >= t.idle {
+			return 0, io.EOF
+		}
+		time.Sleep(poll)
+	}
+}
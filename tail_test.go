@@ -0,0 +1,82 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTailReader(t *testing.T) {
+	type write struct {
+		after time.Duration // since the previous write
+		data  string
+		done  bool // create the .done marker after writing
+	}
+	tests := []struct {
+		name    string
+		idle    time.Duration
+		writes  []write
+		want    string
+		maxTime time.Duration
+	}{
+		{"complete file", 50 * time.Millisecond, nil, "start", time.Second},
+		{"growing", 200 * time.Millisecond, []write{
+			{20 * time.Millisecond, "-one", false},
+			{20 * time.Millisecond, "-two", false},
+			{20 * time.Millisecond, "-three", false},
+		}, "start-one-two-three", 2 * time.Second},
+		// The marker ends it long before idle would
+		{"done marker", time.Minute, []write{
+			{20 * time.Millisecond, "-one", false},
+			{20 * time.Millisecond, "-last", true},
+		}, "start-one-last", 5 * time.Second},
+		// A writer that stalls for longer than idle is taken as finished
+		{"stalled", 50 * time.Millisecond, []write{
+			{300 * time.Millisecond, "-late", false},
+		}, "start", time.Second},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "recording.ts")
+		if err := os.WriteFile(path, []byte("start"), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		writer, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		written := make(chan struct{})
+		go func(writes []write) {
+			defer close(written)
+			defer writer.Close()
+			for _, w := range writes {
+				time.Sleep(w.after)
+				writer.WriteString(w.data)
+				if w.done {
+					os.WriteFile(path+tailDoneSuffix, nil, 0644)
+				}
+			}
+		}(tt.writes)
+
+		file, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		start := time.Now()
+		got, err := io.ReadAll(newTailReader(file, path, tt.idle))
+		elapsed := time.Since(start)
+		file.Close()
+		<-written
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		if string(got) != tt.want {
+			t.Errorf("%s: read %q, want %q", tt.name, got, tt.want)
+		}
+		if elapsed > tt.maxTime {
+			t.Errorf("%s: took %v, want at most %v", tt.name, elapsed, tt.maxTime)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash/fnv"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Telegram wants thumbnails as JPEG of at most 320x320.
+const thumbnailSize = 320
+
+// thumbnailCacheMaxAge is how long an unused generated thumbnail is kept.
+const thumbnailCacheMaxAge = 30 * 24 * time.Hour
+
+func thumbnailCacheDir() string {
+	return filepath.Join(stateDir(), "thumbnails")
+}
+
+// autoThumbnail returns a thumbnail for a document sent without one.
+// generator is "badge" for the built-in extension badge, or a shell command
+// that writes a JPEG to $UPLOADER_THUMBNAIL for $UPLOADER_FILE. Results are
+// cached in the state directory so repeated uploads don't regenerate them.
+func autoThumbnail(generator, path string) (string, error) {
+	if err := os.MkdirAll(thumbnailCacheDir(), 0755); err != nil {
+		return "", fmt.Errorf("failed to create thumbnail cache: %v", err)
+	}
+	pruneThumbnailCache()
+
+	if generator == "badge" {
+		return badgeThumbnail(path)
+	}
+	return commandThumbnail(generator, path)
+}
+
+// pruneThumbnailCache drops thumbnails that haven't been used for a while.
+func pruneThumbnailCache() {
+	entries, err := os.ReadDir(thumbnailCacheDir())
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err == nil && time.Since(info.ModTime()) > thumbnailCacheMaxAge {
+			os.Remove(filepath.Join(thumbnailCacheDir(), entry.Name()))
+		}
+	}
+}
+
+// cachedThumbnail reports whether path exists, marking it as recently used.
+func cachedThumbnail(path string) bool {
+	if _, err := os.Stat(path); err != nil {
+		return false
+	}
+	now := time.Now()
+	os.Chtimes(path, now, now)
+	return true
+}
+
+// commandThumbnail runs a user-supplied generator, e.g. a PDF page render.
+// The cache key covers the path, size and mtime of the source.
+func commandThumbnail(command, path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	abs, _ := filepath.Abs(path)
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%s\x00%d\x00%d", command, abs, info.Size(), info.ModTime().UnixNano())))
+	out := filepath.Join(thumbnailCacheDir(), hex.EncodeToString(sum[:8])+".jpg")
+	if cachedThumbnail(out) {
+		return out, nil
+	}
+
+	tmp := out + ".tmp"
+	defer os.Remove(tmp)
+	cmd := shellCommand(command)
+	cmd.Env = append(os.Environ(), "UPLOADER_FILE="+path, "UPLOADER_THUMBNAIL="+tmp)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("thumbnail command %q failed: %v", command, err)
+	}
+	if _, err := os.Stat(tmp); err != nil {
+		return "", fmt.Errorf("thumbnail command %q did not write $UPLOADER_THUMBNAIL", command)
+	}
+	if err := os.Rename(tmp, out); err != nil {
+		return "", err
+	}
+	return out, nil
+}
+
+// badgeThumbnail draws the file extension in white on a colored square.
+// Badges only depend on the extension, so each is drawn once.
+func badgeThumbnail(path string) (string, error) {
+	ext := strings.ToUpper(strings.TrimPrefix(filepath.Ext(path), "."))
+	if ext == "" {
+		ext = "FILE"
+	}
+	var label []rune
+	for _, r := range ext {
+		if _, ok := badgeFont[r]; ok && len(label) < 5 {
+			label = append(label, r)
+		}
+	}
+	if len(label) == 0 {
+		label = []rune("FILE")
+	}
+
+	out := filepath.Join(thumbnailCacheDir(), "badge-"+string(label)+".jpg")
+	if cachedThumbnail(out) {
+		return out, nil
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, thumbnailSize, thumbnailSize))
+	draw.Draw(img, img.Bounds(), &image.Uniform{badgeColor(string(label))}, image.Point{}, draw.Src)
+
+	// Glyphs are 5x7 cells with one cell of spacing, scaled up to fit
+	scale := (thumbnailSize - 64) / (len(label)*6 - 1)
+	if scale > 16 {
+		scale = 16
+	}
+	x := (thumbnailSize - (len(label)*6-1)*scale) / 2
+	y := (thumbnailSize - 7*scale) / 2
+	white := &image.Uniform{color.White}
+	for _, r := range label {
+		for row, bits := range badgeFont[r] {
+			for col, bit := range bits {
+				if bit != '#' {
+					continue
+				}
+				cell := image.Rect(x+col*scale, y+row*scale, x+(col+1)*scale, y+(row+1)*scale)
+				draw.Draw(img, cell, white, image.Point{}, draw.Src)
+			}
+		}
+		x += 6 * scale
+	}
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 85}); err != nil {
+		return "", err
+	}
+	if err := writeFileAtomic(out, buf.Bytes(), 0644); err != nil {
+		return "", err
+	}
+	return out, nil
+}
+
+// badgeColor picks a stable, fairly dark color for an extension.
+func badgeColor(label string) color.RGBA {
+	palette := []color.RGBA{
+		{0xc0, 0x39, 0x2b, 0xff}, // red
+		{0xd3, 0x54, 0x00, 0xff}, // orange
+		{0x27, 0xae, 0x60, 0xff}, // green
+		{0x16, 0xa0, 0x85, 0xff}, // teal
+		{0x29, 0x80, 0xb9, 0xff}, // blue
+		{0x8e, 0x44, 0xad, 0xff}, // purple
+		{0x2c, 0x3e, 0x50, 0xff}, // slate
+	}
+	h := fnv.New32a()
+	h.Write([]byte(label))
+	return palette[h.Sum32()%uint32(len(palette))]
+}
+
+// badgeFont is a 5x7 bitmap font covering what extensions are made of.
+var badgeFont = map[rune][7]string{
+	'A': {".###.", "#...#", "#...#", "#####", "#...#", "#...#", "#...#"},
+	'B': {"####.", "#...#", "#...#", "####.", "#...#", "#...#", "####."},
+	'C': {".###.", "#...#", "#....", "#....", "#....", "#...#", ".###."},
+	'D': {"####.", "#...#", "#...#", "#...#", "#...#", "#...#", "####."},
+	'E': {"#####", "#....", "#....", "####.", "#....", "#....", "#####"},
+	'F': {"#####", "#....", "#....", "####.", "#....", "#....", "#...."},
+	'G': {".###.", "#...#", "#....", "#.###", "#...#", "#...#", ".####"},
+	'H': {"#...#", "#...#", "#...#", "#####", "#...#", "#...#", "#...#"},
+	'I': {".###.", "..#..", "..#..", "..#..", "..#..", "..#..", ".###."},
+	'J': {"..###", "...#.", "...#.", "...#.", "...#.", "#..#.", ".##.."},
+	'K': {"#...#", "#..#.", "#.#..", "##...", "#.#..", "#..#.", "#...#"},
+	'L': {"#....", "#....", "#....", "#....", "#....", "#....", "#####"},
+	'M': {"#...#", "##.##", "#.#.#", "#.#.#", "#...#", "#...#", "#...#"},
+	'N': {"#...#", "#...#", "##..#", "#.#.#", "#..##", "#...#", "#...#"},
+	'O': {".###.", "#...#", "#...#", "#...#", "#...#", "#...#", ".###."},
+	'P': {"####.", "#...#", "#...#", "####.", "#....", "#....", "#...."},
+	'Q': {".###.", "#...#", "#...#", "#...#", "#.#.#", "#..#.", ".##.#"},
+	'R': {"####.", "#...#", "#...#", "####.", "#.#..", "#..#.", "#...#"},
+	'S': {".####", "#....", "#....", ".###.", "....#", "....#", "####."},
+	'T': {"#####", "..#..", "..#..", "..#..", "..#..", "..#..", "..#.."},
+	'U': {"#...#", "#...#", "#...#", "#...#", "#...#", "#...#", ".###."},
+	'V': {"#...#", "#...#", "#...#", "#...#", "#...#", ".#.#.", "..#.."},
+	'W': {"#...#", "#...#", "#...#", "#.#.#", "#.#.#", "#.#.#", ".#.#."},
+	'X': {"#...#", "#...#", ".#.#.", "..#..", ".#.#.", "#...#", "#...#"},
+	'Y': {"#...#", "#...#", ".#.#.", "..#..", "..#..", "..#..", "..#.."},
+	'Z': {"#####", "....#", "...#.", "..#..", ".#...", "#....", "#####"},
+	'0': {".###.", "#...#", "#..##", "#.#.#", "##..#", "#...#", ".###."},
+	'1': {"..#..", ".##..", "..#..", "..#..", "..#..", "..#..", ".###."},
+	'2': {".###.", "#...#", "....#", "...#.", "..#..", ".#...", "#####"},
+	'3': {"####.", "....#", "....#", ".###.", "....#", "....#", "####."},
+	'4': {"...#.", "..##.", ".#.#.", "#..#.", "#####", "...#.", "...#."},
+	'5': {"#####", "#....", "####.", "....#", "....#", "#...#", ".###."},
+	'6': {".###.", "#....", "#....", "####.", "#...#", "#...#", ".###."},
+	'7': {"#####", "....#", "...#.", "..#..", ".#...", ".#...", ".#..."},
+	'8': {".###.", "#...#", "#...#", ".###.", "#...#", "#...#", ".###."},
+	'9': {".###.", "#...#", "#...#", ".####", "....#", "....#", ".###."},
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+const topicCacheName = "topics.json"
+
+// topicCache maps forum chats to their topic names and thread IDs. The Bot
+// API can't list a forum's topics, so names are only known once created
+// here or recorded with "uploader config topic".
+type topicCache map[string]map[string]int
+
+func topicCacheFile() string {
+	return filepath.Join(stateDir(), topicCacheName)
+}
+
+func loadTopicCache() (topicCache, error) {
+	cache := make(topicCache)
+	data, err := os.ReadFile(topicCacheFile())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return cache, nil
+		}
+		return nil, fmt.Errorf("failed to read topic cache: %v", err)
+	}
+	if err := json.Unmarshal(data, &cache); err != nil {
+		return nil, fmt.Errorf("failed to parse topic cache %s: %v", topicCacheFile(), err)
+	}
+	return cache, nil
+}
+
+// rememberTopic records the thread ID of a named topic in chatID.
+func rememberTopic(chatID int64, name string, threadID int) error {
+	cache, err := loadTopicCache()
+	if err != nil {
+		return err
+	}
+	chat := strconv.FormatInt(chatID, 10)
+	if cache[chat] == nil {
+		cache[chat] = make(map[string]int)
+	}
+	cache[chat][name] = threadID
+
+	data, err := json.MarshalIndent(cache, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(stateDir(), 0755); err != nil {
+		return fmt.Errorf("failed to create directory: %v", err)
+	}
+	return writeFileAtomic(topicCacheFile(), append(data, '\n'), 0644)
+}
+
+// resolveTopic returns the thread ID for -topic: a number is used as is, a
+// name is looked up in the cache and, if create is set, made with
+// createForumTopic when it isn't there yet.
+func resolveTopic(botToken string, chatID int64, topic string, create bool) (int, error) {
+	if threadID, err := strconv.Atoi(topic); err == nil {
+		return threadID, nil
+	}
+
+	cache, err := loadTopicCache()
+	if err != nil {
+		return 0, err
+	}
+	if threadID, ok := cache[strconv.FormatInt(chatID, 10)][topic]; ok {
+		return threadID, nil
+	}
+	if !create {
+		return 0, fmt.Errorf("unknown topic %q in chat %d; pass its thread ID, or -create-topic to create it", topic, chatID)
+	}
+
+	raw, err := callAPI(botToken, "createForumTopic", url.Values{
+		"chat_id": {strconv.FormatInt(chatID, 10)},
+		"name":    {topic},
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to create topic %q: %v", topic, err)
+	}
+	var created struct {
+		MessageThreadID int `json:"message_thread_id"`
+	}
+	if err := json.Unmarshal(raw, &created); err != nil {
+		return 0, fmt.Errorf("failed to decode createForumTopic: %v", err)
+	}
+	logf("Created topic %q in chat %d (thread %d)\n", topic, chatID, created.MessageThreadID)
+	if err := rememberTopic(chatID, topic, created.MessageThreadID); err != nil {
+		logf("Warning: failed to cache topic: %v\n", err)
+	}
+	return created.MessageThreadID, nil
+}
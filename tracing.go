@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Tracing is a minimal OpenTelemetry exporter speaking OTLP/HTTP with JSON
+// encoding, which every collector accepts. It is enabled by the standard
+// OTEL_EXPORTER_OTLP_ENDPOINT / OTEL_EXPORTER_OTLP_TRACES_ENDPOINT variables
+// (or --otlp-endpoint), and joins the caller's trace when TRACEPARENT holds a
+// W3C trace context, so uploads show up inside the bot's end-to-end traces.
+
+var tracer *spanCollector
+
+type spanCollector struct {
+	mu       sync.Mutex
+	endpoint string
+	traceID  [16]byte
+	parentID [8]byte // remote parent from TRACEPARENT, zero if none
+	spans    []*span
+}
+
+type span struct {
+	name     string
+	spanID   [8]byte
+	parentID [8]byte
+	start    time.Time
+	end      time.Time
+	attrs    map[string]interface{}
+	err      error
+}
+
+// initTracing enables span collection if an OTLP endpoint is configured.
+func initTracing(endpoint string) {
+	if endpoint == "" {
+		if e := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"); e != "" {
+			endpoint = e
+		} else if e := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); e != "" {
+			endpoint = strings.TrimSuffix(e, "/") + "/v1/traces"
+		}
+	}
+	if endpoint == "" {
+		return
+	}
+
+	tracer = &spanCollector{endpoint: endpoint}
+	if !parseTraceparent(os.Getenv("TRACEPARENT"), &tracer.traceID, &tracer.parentID) {
+		rand.Read(tracer.traceID[:])
+	}
+}
+
+// parseTraceparent decodes a "00-<trace-id>-<parent-id>-<flags>" header.
+func parseTraceparent(value string, traceID *[16]byte, parentID *[8]byte) bool {
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) != 4 || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return false
+	}
+	if _, err := hex.Decode(traceID[:], []byte(parts[1])); err != nil {
+		return false
+	}
+	if _, err := hex.Decode(parentID[:], []byte(parts[2])); err != nil {
+		return false
+	}
+	return true
+}
+
+// startSpan begins a span under parent, or under the remote parent (if any)
+// when parent is nil. It returns nil when tracing is disabled; all span
+// methods accept a nil receiver.
+func startSpan(parent *span, name string) *span {
+	if tracer == nil {
+		return nil
+	}
+
+	s := &span{
+		name:  name,
+		start: time.Now(),
+		attrs: make(map[string]interface{}),
+	}
+	rand.Read(s.spanID[:])
+	if parent != nil {
+		s.parentID = parent.spanID
+	} else {
+		s.parentID = tracer.parentID
+	}
+	return s
+}
+
+func (s *span) setAttr(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.attrs[key] = value
+}
+
+// finish records the span, marking it as failed when err is non-nil.
+func (s *span) finish(err error) {
+	if s == nil {
+		return
+	}
+	s.end = time.Now()
+	s.err = err
+
+	tracer.mu.Lock()
+	tracer.spans = append(tracer.spans, s)
+	tracer.mu.Unlock()
+}
+
+// flushTraces exports all finished spans. Failures are logged, never fatal.
+func flushTraces() {
+	if tracer == nil {
+		return
+	}
+
+	tracer.mu.Lock()
+	spans := tracer.spans
+	tracer.spans = nil
+	tracer.mu.Unlock()
+	if len(spans) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(otlpPayload(spans))
+	if err != nil {
+		logf("Failed to encode traces: %v\n", err)
+		return
+	}
+
+	client := &http.Client{
+		Timeout: 10 * time.Second,
+	}
+	resp, err := client.Post(tracer.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		logf("Failed to export traces: %v\n", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		logf("Failed to export traces: collector returned %s\n", resp.Status)
+	}
+}
+
+func otlpPayload(spans []*span) map[string]interface{} {
+	otlpSpans := make([]map[string]interface{}, 0, len(spans))
+	for _, s := range spans {
+		entry := map[string]interface{}{
+			"traceId":           hex.EncodeToString(tracer.traceID[:]),
+			"spanId":            hex.EncodeToString(s.spanID[:]),
+			"name":              s.name,
+			"kind":              1, // SPAN_KIND_INTERNAL
+			"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+			"attributes":        otlpAttributes(s.attrs),
+		}
+		if s.parentID != [8]byte{} {
+			entry["parentSpanId"] = hex.EncodeToString(s.parentID[:])
+		}
+		if s.err != nil {
+			entry["status"] = map[string]interface{}{"code": 2, "message": s.err.Error()}
+		}
+		otlpSpans = append(otlpSpans, entry)
+	}
+
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": otlpAttributes(map[string]interface{}{"service.name": "uploader"}),
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]interface{}{"name": "uploader"},
+						"spans": otlpSpans,
+					},
+				},
+			},
+		},
+	}
+}
+
+func otlpAttributes(attrs map[string]interface{}) []interface{} {
+	list := make([]interface{}, 0, len(attrs))
+	for key, value := range attrs {
+		var v map[string]interface{}
+		switch value := value.(type) {
+		case int:
+			v = map[string]interface{}{"intValue": strconv.Itoa(value)}
+		case int64:
+			v = map[string]interface{}{"intValue": strconv.FormatInt(value, 10)}
+		case bool:
+			v = map[string]interface{}{"boolValue": value}
+		default:
+			v = map[string]interface{}{"stringValue": fmt.Sprint(value)}
+		}
+		list = append(list, map[string]interface{}{"key": key, "value": v})
+	}
+	return list
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// isTooLarge reports whether err is Telegram refusing a file as too large,
+// or a plain HTTP 413 from a proxy or local server in front of it.
+func isTooLarge(err error) bool {
+	var telegramErr *TelegramError
+	if errors.As(err, &telegramErr) {
+		return telegramErr.IsTooLarge()
+	}
+	var statusErr *httpError
+	return errors.As(err, &statusErr) && statusErr.status == http.StatusRequestEntityTooLarge
+}
+
+// transcodeSmaller runs the -transcode-413 command to re-encode path at a
+// lower quality. The command reads $UPLOADER_FILE and writes
+// $UPLOADER_OUTPUT, which keeps the extension and base name of the
+// original. The caller removes the returned directory when done.
+func transcodeSmaller(command, path string) (output, dir string, err error) {
+	if dir, err = makeWorkDir("transcode-"); err != nil {
+		return "", "", err
+	}
+	output = filepath.Join(dir, filepath.Base(path))
+
+	cmd := shellCommand(command)
+	cmd.Env = append(os.Environ(), "UPLOADER_FILE="+path, "UPLOADER_OUTPUT="+output)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		os.RemoveAll(dir)
+		return "", "", fmt.Errorf("transcode command %q failed: %v", command, err)
+	}
+	if _, err := os.Stat(output); err != nil {
+		os.RemoveAll(dir)
+		return "", "", fmt.Errorf("transcode command %q did not write $UPLOADER_OUTPUT", command)
+	}
+	return output, dir, nil
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Connection settings shared by the upload and every subcommand that talks
+// to the Bot API.
+var (
+	tlsCACert     string
+	tlsClientCert string
+	tlsClientKey  string
+	tlsInsecure   bool
+
+	forceIPv4    bool
+	forceIPv6    bool
+	resolveRules stringList
+	apiSocket    string
+	extraHeaders stringList
+
+	apiTransport http.RoundTripper = http.DefaultTransport
+)
+
+// addConnectionFlags registers the flags that control how the Bot API is
+// reached.
+func addConnectionFlags(fs *flag.FlagSet) {
+	fs.StringVar(&apiBaseURL, "api-url", defaultAPIURL, "Bot API server URL, e.g. http://localhost:8081 for a local telegram-bot-api")
+	fs.StringVar(&tlsCACert, "ca-cert", "", "PEM bundle of extra CAs to trust (e.g. a TLS-intercepting proxy or a private CA)")
+	fs.StringVar(&tlsClientCert, "client-cert", "", "PEM client certificate for mutual TLS")
+	fs.StringVar(&tlsClientKey, "client-key", "", "PEM private key for -client-cert")
+	fs.BoolVar(&tlsInsecure, "insecure-skip-verify", false, "DANGEROUS: do not verify the server certificate")
+	fs.BoolVar(&forceIPv4, "ipv4", false, "connect over IPv4 only")
+	fs.BoolVar(&forceIPv6, "ipv6", false, "connect over IPv6 only")
+	fs.Var(&resolveRules, "resolve", "connect to addr instead of resolving host, as host:addr (repeatable)")
+	fs.StringVar(&apiSocket, "api-socket", "", "reach a local telegram-bot-api over this unix domain socket (plain HTTP)")
+	fs.Var(&extraHeaders, "header", "extra HTTP header for Bot API requests, as \"Name: value\" (repeatable)")
+	fs.IntVar(&maxConcurrent, "max-concurrent", 0, "most Bot API requests in flight at once per bot token, uploads included (0: unlimited; config \"limits\" override per bot)")
+	fs.Float64Var(&requestsPerSecond, "max-rps", 0, "most Bot API requests started per second per bot token (0: unlimited)")
+	fs.Var(&copyBufferSize, "buffer-size", "chunk size for streaming file data to the server, e.g. 1M")
+	fs.Var(&botAPIVersion, "bot-api-version", "Bot API version of the server, e.g. 6.5, or auto to probe it (default: current)")
+}
+
+// stringList is a flag that may be given several times.
+type stringList []string
+
+func (l *stringList) String() string     { return strings.Join(*l, ",") }
+func (l *stringList) Set(v string) error { *l = append(*l, v); return nil }
+
+// splitList splits a comma-separated value, dropping empty items.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// newDialer returns a DialContext honoring the IP family and -resolve
+// overrides.
+func newDialer() (func(ctx context.Context, network, address string) (net.Conn, error), error) {
+	if forceIPv4 && forceIPv6 {
+		return nil, fmt.Errorf("-ipv4 and -ipv6 are mutually exclusive")
+	}
+
+	overrides := make(map[string]string)
+	for _, rule := range resolveRules {
+		host, addr, ok := strings.Cut(rule, ":")
+		if !ok || host == "" || net.ParseIP(addr) == nil {
+			return nil, fmt.Errorf("invalid -resolve %q, want host:ip", rule)
+		}
+		overrides[strings.ToLower(host)] = addr
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		if apiSocket != "" {
+			return dialer.DialContext(ctx, "unix", apiSocket)
+		}
+		if forceIPv4 {
+			network = "tcp4"
+		} else if forceIPv6 {
+			network = "tcp6"
+		}
+		if host, port, err := net.SplitHostPort(address); err == nil {
+			if addr, ok := overrides[strings.ToLower(host)]; ok {
+				address = net.JoinHostPort(addr, port)
+			}
+		}
+		return dialer.DialContext(ctx, network, address)
+	}, nil
+}
+
+// setupTransport builds the HTTP transport from the connection flags and
+// adds the configured request headers.
+func setupTransport() error {
+	if err := configureTransport(); err != nil {
+		return err
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	headers, err := requestHeaders(cfg)
+	if err != nil {
+		return err
+	}
+	if len(headers) > 0 {
+		apiTransport = &headerTransport{base: apiTransport, headers: headers}
+	}
+
+	global := tokenLimits{MaxConcurrent: maxConcurrent, RequestsPerSecond: requestsPerSecond}
+	if global.MaxConcurrent < 0 || global.RequestsPerSecond < 0 {
+		return fmt.Errorf("-max-concurrent and -max-rps must not be negative")
+	}
+	if len(cfg.Limits) > 0 || global != (tokenLimits{}) {
+		apiTransport = &limitTransport{
+			base:     apiTransport,
+			limits:   cfg.Limits,
+			global:   global,
+			limiters: make(map[string]*tokenLimiter),
+		}
+	}
+	return nil
+}
+
+// requestHeaders collects the headers from the config file and -header
+// flags, the flags winning.
+func requestHeaders(cfg *config) (http.Header, error) {
+	headers := make(http.Header)
+	for name, value := range cfg.Headers {
+		headers.Set(name, value)
+	}
+
+	for _, header := range extraHeaders {
+		name, value, ok := strings.Cut(header, ":")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid -header %q, want \"Name: value\"", header)
+		}
+		headers.Set(name, strings.TrimSpace(value))
+	}
+	return headers, nil
+}
+
+// headerTransport adds fixed headers to every request, e.g. credentials for
+// a reverse proxy in front of a local Bot API server.
+type headerTransport struct {
+	base    http.RoundTripper
+	headers http.Header
+}
+
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// RoundTrippers must not modify the caller's request
+	req = req.Clone(req.Context())
+	for name, values := range t.headers {
+		req.Header[name] = values
+	}
+	return t.base.RoundTrip(req)
+}
+
+// configureTransport sets up TLS and dialing from the connection flags.
+func configureTransport() error {
+	if tlsCACert == "" && tlsClientCert == "" && !tlsInsecure &&
+		!forceIPv4 && !forceIPv6 && len(resolveRules) == 0 && apiSocket == "" {
+		return nil
+	}
+
+	// Over a socket the host part of the URL is irrelevant, but the scheme
+	// must be plain HTTP
+	if apiSocket != "" && apiBaseURL == defaultAPIURL {
+		apiBaseURL = "http://localhost"
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	dial, err := newDialer()
+	if err != nil {
+		return err
+	}
+	transport.DialContext = dial
+
+	tlsConfig := &tls.Config{}
+
+	if tlsCACert != "" {
+		pem, err := os.ReadFile(tlsCACert)
+		if err != nil {
+			return fmt.Errorf("failed to read CA bundle: %v", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in CA bundle %s", tlsCACert)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if tlsClientCert != "" || tlsClientKey != "" {
+		if tlsClientCert == "" || tlsClientKey == "" {
+			return fmt.Errorf("-client-cert and -client-key must be given together")
+		}
+		cert, err := tls.LoadX509KeyPair(tlsClientCert, tlsClientKey)
+		if err != nil {
+			return fmt.Errorf("failed to load client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if tlsInsecure {
+		logf("WARNING: TLS certificate verification is disabled; the connection is open to interception\n")
+		tlsConfig.InsecureSkipVerify = true
+	}
+
+	transport.TLSClientConfig = tlsConfig
+	apiTransport = transport
+	return nil
+}
+
+// Clients are shared by timeout so repeated requests don't each build one.
+var (
+	httpClientsMu sync.Mutex
+	httpClients   = make(map[time.Duration]*http.Client)
+)
+
+// httpClient returns a client for Bot API requests.
+func httpClient(timeout time.Duration) *http.Client {
+	httpClientsMu.Lock()
+	defer httpClientsMu.Unlock()
+	// setupTransport may have replaced the transport since
+	if client, ok := httpClients[timeout]; ok && client.Transport == apiTransport {
+		return client
+	}
+	client := &http.Client{
+		Timeout:   timeout,
+		Transport: apiTransport,
+	}
+	httpClients[timeout] = client
+	return client
+}
+
+// copyBufferSize is the chunk size file data is streamed to the server in;
+// larger chunks mean fewer writes through the request pipe.
+var copyBufferSize = byteSize(256 << 10)
+
+// copyBuffers recycles the file copy buffers between uploads.
+var copyBuffers sync.Pool
+
+// getCopyBuffer returns a buffer of copyBufferSize; hand it back with
+// copyBuffers.Put when done.
+func getCopyBuffer() *[]byte {
+	if buf, ok := copyBuffers.Get().(*[]byte); ok && len(*buf) == int(copyBufferSize) {
+		return buf
+	}
+	buf := make([]byte, copyBufferSize)
+	return &buf
+}
+
+// byteSize is a flag taking a size such as 512K or 4M.
+type byteSize int64
+
+func (b *byteSize) String() string { return formatSize(int64(*b)) }
+
+func (b *byteSize) Set(value string) error {
+	n, err := parseSize(value)
+	if err != nil {
+		return err
+	}
+	if n < 4<<10 || n > 64<<20 {
+		return fmt.Errorf("size must be between 4K and 64M")
+	}
+	*b = byteSize(n)
+	return nil
+}
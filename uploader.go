@@ -1,12 +1,19 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
+	"mime"
 	"mime/multipart"
 	"net/http"
 	"net/textproto" // <--- ADD THIS IMPORT
+	"net/url"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -15,94 +22,923 @@ import (
 )
 
 const (
-	telegramAPIURL          = "https://api.telegram.org/bot"
-	lastUploadTimestampFile = "/opt/docker/repos/musicbot/bot/last_upload.txt"
+	defaultAPIURL           = "https://api.telegram.org"
+	lastUploadTimestampName = "last_upload.txt"
+
+	// legacyLastUploadTimestampFile is where the timestamp lived before
+	// the state directory; it is moved over on the first run that finds it
+	legacyLastUploadTimestampFile = "/opt/docker/repos/musicbot/bot/last_upload.txt"
+
+	// stateDirEnv overrides the directory used for persistent state
+	stateDirEnv = "UPLOADER_STATE_DIR"
 )
 
+// apiBaseURL is the Bot API server, overridable to use a local
+// telegram-bot-api instance.
+var apiBaseURL = defaultAPIURL
+
+// methodURL returns the endpoint URL of a Bot API method.
+func methodURL(botToken, method string) string {
+	return fmt.Sprintf("%s/bot%s/%s", strings.TrimSuffix(apiBaseURL, "/"), botToken, method)
+}
+
 type TelegramResponse struct {
-	OK          bool   `json:"ok"`
-	Description string `json:"description"`
+	OK          bool               `json:"ok"`
+	ErrorCode   int                `json:"error_code"`
+	Description string             `json:"description"`
+	Parameters  ResponseParameters `json:"parameters"`
 	Result      struct {
-		MessageID int    `json:"message_id"`
-		FileID    string `json:"file_id"`
+		MessageID int            `json:"message_id"`
+		Date      int64          `json:"date"`
+		Audio     *telegramFile  `json:"audio"`
+		Document  *telegramFile  `json:"document"`
+		Video     *telegramFile  `json:"video"`
+		Photo     []telegramFile `json:"photo"`
 	} `json:"result"`
 }
 
+type telegramFile struct {
+	FileID       string `json:"file_id"`
+	FileUniqueID string `json:"file_unique_id"`
+	FileSize     int64  `json:"file_size"`
+}
+
+// media returns the file in the sent message, or nil if there is none.
+func (r *TelegramResponse) media() *telegramFile {
+	switch {
+	case r.Result.Audio != nil:
+		return r.Result.Audio
+	case r.Result.Document != nil:
+		return r.Result.Document
+	case r.Result.Video != nil:
+		return r.Result.Video
+	case len(r.Result.Photo) > 0:
+		// Photo sizes are ordered smallest first
+		return &r.Result.Photo[len(r.Result.Photo)-1]
+	}
+	return nil
+}
+
+// fileID returns the file_id of the media in the sent message, if any.
+func (r *TelegramResponse) fileID() string {
+	if file := r.media(); file != nil {
+		return file.FileID
+	}
+	return ""
+}
+
+// fileSize returns the size Telegram reports for the media in the sent
+// message, or 0 if it doesn't say.
+func (r *TelegramResponse) fileSize() int64 {
+	switch {
+	case r.Result.Audio != nil:
+		return r.Result.Audio.FileSize
+	case r.Result.Document != nil:
+		return r.Result.Document.FileSize
+	case r.Result.Video != nil:
+		return r.Result.Video.FileSize
+	}
+	// Photos are recompressed, so their size says nothing about the upload
+	return 0
+}
+
+// uploadResult describes a successful upload.
+type uploadResult struct {
+	ChatID     int64 // differs from the requested chat after a migration
+	MessageID  int
+	FileID     string
+	SHA256     string // hex digest of the bytes sent
+	Size       int64
+	StoredSize int64 // size Telegram reports for the file, 0 if unknown
+
+	// The rest of what Telegram returned, so callers need no getFile
+	FileUniqueID string
+	Date         int64           // unix time the message was sent
+	Message      json.RawMessage // the sent message as Telegram returned it
+
+	// Transcoded is set when the file was too large and a re-encoded copy
+	// went out instead
+	Transcoded bool
+
+	// Caption is the caption as sent, after fitting it to the limit, and
+	// FollowUps what -caption-overflow followup sent after it
+	Caption   string
+	FollowUps []string
+}
+
+// stateDir returns the directory holding persistent state. It honors
+// UPLOADER_STATE_DIR and otherwise uses the platform cache directory
+// ($XDG_CACHE_HOME or ~/.cache on Linux, ~/Library/Caches on macOS,
+// %LocalAppData% on Windows).
+func stateDir() string {
+	if dir := os.Getenv(stateDirEnv); dir != "" {
+		return dir
+	}
+	if dir, err := os.UserCacheDir(); err == nil {
+		return filepath.Join(dir, "uploader")
+	}
+	// No home directory (e.g. a bare container user), fall back to temp
+	return filepath.Join(os.TempDir(), "uploader")
+}
+
+// checkStateDir makes sure the state directory can be written before any
+// bytes are sent. Otherwise an upload could succeed and then fail to record
+// itself, and a retry would post it twice.
+func checkStateDir() error {
+	dir := stateDir()
+	hint := fmt.Sprintf("set %s to a writable directory", stateDirEnv)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("cannot create state directory %s: %v (%s)", dir, err, hint)
+	}
+	probe, err := os.CreateTemp(dir, ".preflight-*")
+	if err != nil {
+		return fmt.Errorf("state directory %s is not writable: %v (%s)", dir, err, hint)
+	}
+	probe.Close()
+	if err := os.Remove(probe.Name()); err != nil {
+		return err
+	}
+	removeStaleTempFiles(dir)
+	removeStaleWorkDirs()
+	migrateLegacyTimestamp()
+	return nil
+}
+
+// migrateLegacyTimestamp moves the last upload timestamp from its old fixed
+// path into the state directory, so -delay still holds across the upgrade.
+func migrateLegacyTimestamp() {
+	if _, err := os.Stat(lastUploadTimestampFile()); !os.IsNotExist(err) {
+		return
+	}
+	data, err := os.ReadFile(legacyLastUploadTimestampFile)
+	if err != nil {
+		return
+	}
+	if err := writeFileAtomic(lastUploadTimestampFile(), data, 0644); err != nil {
+		logf("Warning: failed to move %s into the state directory: %v\n", legacyLastUploadTimestampFile, err)
+		return
+	}
+	if err := os.Remove(legacyLastUploadTimestampFile); err != nil {
+		logf("Warning: failed to remove %s: %v\n", legacyLastUploadTimestampFile, err)
+		return
+	}
+	logf("Moved %s to %s\n", legacyLastUploadTimestampFile, lastUploadTimestampFile())
+}
+
+// staleTempFileAge is how old a temp file from writeFileAtomic must be
+// before it is taken to be left over from a crash.
+const staleTempFileAge = time.Hour
+
+// removeStaleTempFiles deletes temp files that writeFileAtomic never got to
+// rename or remove because the process died in between.
+func removeStaleTempFiles(dir string) {
+	matches, _ := filepath.Glob(filepath.Join(dir, ".*.tmp-*"))
+	for _, path := range matches {
+		info, err := os.Stat(path)
+		if err == nil && time.Since(info.ModTime()) > staleTempFileAge {
+			if os.Remove(path) == nil {
+				logf("Removed %s left behind by an interrupted run\n", path)
+			}
+		}
+	}
+}
+
+// tmpDir is the -tmp-dir setting; empty means workDir's default.
+var tmpDir string
+
+// workDir holds the scratch copies of files made for an upload: -tmp-dir,
+// or a directory inside the state directory. Either way leftovers of a
+// killed run are found and removed.
+func workDir() string {
+	if tmpDir != "" {
+		return tmpDir
+	}
+	return filepath.Join(stateDir(), "work")
+}
+
+// staleWorkDirAge is how old a scratch directory must be before it is taken
+// to be left over from a crash rather than in use by a slow upload.
+const staleWorkDirAge = 24 * time.Hour
+
+// workDirPrefix starts the name of every scratch directory, so sweeping a
+// shared -tmp-dir only ever touches the uploader's own.
+const workDirPrefix = "uploader-"
+
+// makeWorkDir creates a scratch directory for one upload. The caller
+// removes it when done.
+func makeWorkDir(prefix string) (string, error) {
+	if err := os.MkdirAll(workDir(), 0755); err != nil {
+		return "", fmt.Errorf("failed to create temp directory: %v", err)
+	}
+	dir, err := os.MkdirTemp(workDir(), workDirPrefix+prefix)
+	if err != nil {
+		return "", fmt.Errorf("failed to create temp directory: %v", err)
+	}
+	return dir, nil
+}
+
+// removeStaleWorkDirs deletes scratch directories that a killed run never
+// got to remove.
+func removeStaleWorkDirs() {
+	entries, _ := os.ReadDir(workDir())
+	for _, entry := range entries {
+		if !entry.IsDir() || !strings.HasPrefix(entry.Name(), workDirPrefix) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || time.Since(info.ModTime()) <= staleWorkDirAge {
+			continue
+		}
+		path := filepath.Join(workDir(), entry.Name())
+		if os.RemoveAll(path) == nil {
+			logf("Removed %s left behind by an interrupted run\n", path)
+		}
+	}
+}
+
+func lastUploadTimestampFile() string {
+	return filepath.Join(stateDir(), lastUploadTimestampName)
+}
+
 func writeLastUploadTime() error {
+	return writeTimestamp(lastUploadTimestampFile())
+}
+
+// writeTimestamp records the current time in a state file.
+func writeTimestamp(path string) error {
 	// Ensure the directory exists
-	err := os.MkdirAll(filepath.Dir(lastUploadTimestampFile), 0755)
+	err := os.MkdirAll(filepath.Dir(path), 0755)
 	if err != nil {
 		return fmt.Errorf("failed to create directory: %v", err)
 	}
 
 	// Write current timestamp to file
 	currentTime := time.Now().Unix()
-	return os.WriteFile(lastUploadTimestampFile, []byte(strconv.FormatInt(currentTime, 10)), 0644)
+	return writeFileAtomic(path, []byte(strconv.FormatInt(currentTime, 10)), 0644)
 }
 
-func checkAndWaitForDelay(delaySeconds int) error {
-	// If no delay specified, return immediately
-	if delaySeconds <= 0 {
-		return nil
+// writeFileAtomic writes data to a temp file next to path, fsyncs it and
+// renames it into place, so a crash never leaves a half-written state file.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file: %v", err)
 	}
+	tmpName := tmp.Name()
+
+	// Remove the temp file on any failure path
+	success := false
+	defer func() {
+		if !success {
+			os.Remove(tmpName)
+		}
+	}()
 
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write temp file: %v", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to sync temp file: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close temp file: %v", err)
+	}
+	if err := os.Chmod(tmpName, perm); err != nil {
+		return fmt.Errorf("failed to set permissions: %v", err)
+	}
+	if err := os.Rename(tmpName, path); err != nil {
+		return fmt.Errorf("failed to rename temp file: %v", err)
+	}
+	success = true
+
+	// Best effort: persist the rename itself by syncing the directory
+	if dir, err := os.Open(filepath.Dir(path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+
+	return nil
+}
+
+// readLastUploadTime returns the time of the last successful upload, or the
+// zero time if there has been none yet.
+func readLastUploadTime() (time.Time, error) {
+	return readTimestamp(lastUploadTimestampFile())
+}
+
+// readTimestamp reads a time written by writeTimestamp, returning the zero
+// time if the file does not exist.
+func readTimestamp(path string) (time.Time, error) {
 	// Check if the last upload timestamp file exists
-	data, err := os.ReadFile(lastUploadTimestampFile)
+	data, err := os.ReadFile(path)
 	if err != nil {
-		// If file doesn't exist, it means no previous upload, so continue
+		// If file doesn't exist, it means no previous upload
 		if os.IsNotExist(err) {
-			return nil
+			return time.Time{}, nil
 		}
-		return fmt.Errorf("failed to read last upload timestamp: %v", err)
+		return time.Time{}, fmt.Errorf("failed to read last upload timestamp: %v", err)
 	}
 
-	// Parse the last upload timestamp
-	lastUploadTime, err := strconv.ParseInt(string(data), 10, 64)
+	// Parse the last upload timestamp. A truncated or garbled file must not
+	// block uploads, so treat it like a missing one and carry on.
+	lastUploadTime, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
 	if err != nil {
-		return fmt.Errorf("failed to parse last upload timestamp: %v", err)
+		logf("Ignoring unreadable last upload timestamp in %s: %v\n", path, err)
+		return time.Time{}, nil
+	}
+
+	return time.Unix(lastUploadTime, 0), nil
+}
+
+func checkAndWaitForDelay(delaySeconds int) error {
+	return waitForDelay(lastUploadTimestampFile(), delaySeconds)
+}
+
+// waitForDelay sleeps until delaySeconds have passed since the time
+// recorded in path.
+func waitForDelay(path string, delaySeconds int) error {
+	// If no delay specified, return immediately
+	if delaySeconds <= 0 {
+		return nil
+	}
+
+	lastUploadTime, err := readTimestamp(path)
+	if err != nil {
+		return err
+	}
+	if lastUploadTime.IsZero() {
+		return nil
 	}
 
 	// Calculate time since last upload
-	timeSinceLastUpload := time.Since(time.Unix(lastUploadTime, 0))
+	timeSinceLastUpload := time.Since(lastUploadTime)
 
 	// If not enough time has passed, sleep
 	if timeSinceLastUpload < time.Duration(delaySeconds)*time.Second {
 		sleepDuration := time.Duration(delaySeconds)*time.Second - timeSinceLastUpload
-		fmt.Printf("Delaying upload for %v...\n", sleepDuration.Round(time.Second)) // Added for debugging
+		logf("Delaying upload for %v...\n", sleepDuration.Round(time.Second))
 		time.Sleep(sleepDuration)
 	}
 
 	return nil
 }
 
-func uploadFile(botToken, filePath, title, performer, thumbnailPath string,
-	chatID int64, duration, replyToMessageID int, parseMode string, delaySeconds int) (int, error) {
+// sleepContext sleeps for d, returning early with the context's error if
+// it ends first.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// uploadOptions describes a single upload job.
+type uploadOptions struct {
+	BotToken         string `json:"-"` // never persisted
+	JobID            string
+	ChatID           int64
+	FilePath         string
+	Title            string
+	Performer        string
+	Duration         int
+	ReplyToMessageID int
+	ThumbnailPath    string
+	ParseMode        string
+	DelaySeconds     int
+
+	// Retries is how many extra attempts a retryable failure gets, with
+	// RetryDelay doubling between attempts.
+	Retries    int
+	RetryDelay time.Duration
+
+	// Caption replaces the title as caption, and gives audio one too
+	Caption string
+
+	// CaptionOverflow selects how over-long captions are handled
+	CaptionOverflow string
+
+	// PaidStars posts the file as star-gated paid media when positive
+	PaidStars int
+
+	// MimeType overrides the Content-Type of the file part
+	MimeType string
+
+	// AllowSendingWithoutReply posts the file even if ReplyToMessageID
+	// no longer exists
+	AllowSendingWithoutReply bool
+
+	// AsDocument sends audio and video files with sendDocument, skipping the player
+	AsDocument bool
+
+	// WaitStable holds the upload until the file has stopped changing for
+	// this long
+	WaitStable time.Duration
+
+	// ThreadID posts into a forum topic
+	ThreadID int
+
+	// PublishChatID, when set, makes ChatID a staging chat: the upload is
+	// copied to PublishChatID once it checks out, replying to
+	// PublishReplyTo in topic PublishThreadID there
+	PublishChatID   int64
+	PublishReplyTo  int
+	PublishThreadID int
+
+	// ProtectContent stops the message from being forwarded or saved
+	ProtectContent bool
+
+	// Watermark is a logo image drawn onto paid photos and video
+	// thumbnails at WatermarkPosition, or handed to WatermarkCommand
+	Watermark         string
+	WatermarkCommand  string
+	WatermarkPosition string
+	WatermarkOpacity  float64
+
+	// Timeout bounds all attempts and the waits between them; 0 means no
+	// limit beyond the per-request one
+	Timeout time.Duration
+
+	// Transcode is a shell command re-encoding the file smaller, run once
+	// if Telegram rejects it as too large
+	Transcode string
+
+	// Tail uploads the file while it is still being written, ending once it
+	// hasn't grown for this long or a "<file>.done" marker exists
+	Tail time.Duration
+
+	// Progress, if set, is called as the file is read during an upload
+	Progress func(sent, total int64) `json:"-"`
+
+	// NoStreaming leaves supports_streaming unset for audio and video
+	NoStreaming bool
+
+	// ChatAction shows "sending file..." in the chat during the upload
+	ChatAction bool
+
+	// Rewrites applied to the multipart filename, not the file on disk
+	NormalizeFilename     bool
+	TransliterateFilename bool
+	SanitizeFilename      bool
+}
+
+// retryableError marks a failure that may succeed on another attempt, such
+// as a network error, a 5xx or a flood wait.
+type retryableError struct {
+	err    error
+	after  time.Duration // minimum wait requested by the server, if any
+	status int           // HTTP status of the failed response, if any
+}
+
+func (e *retryableError) Error() string { return e.err.Error() }
+func (e *retryableError) Unwrap() error { return e.err }
+
+// httpError is a response that isn't a Bot API reply at all, such as an
+// error page from a reverse proxy, keeping its HTTP status.
+type httpError struct {
+	status int
+	err    error
+}
+
+func (e *httpError) Error() string { return e.err.Error() }
+func (e *httpError) Unwrap() error { return e.err }
+
+// TelegramError is an unsuccessful Bot API response. Use errors.As to get
+// it from the errors returned here, which may wrap it in a retryableError.
+type TelegramError struct {
+	Code        int
+	Description string
+	Parameters  ResponseParameters
+}
+
+func (e *TelegramError) Error() string { return "telegram API error: " + e.Description }
+
+// IsBadRequest reports a request Telegram rejected as invalid, e.g. a
+// wrong chat ID or an unusable file.
+func (e *TelegramError) IsBadRequest() bool { return e.Code == http.StatusBadRequest }
+
+// IsForbidden reports that the bot may not post to the chat: it was
+// kicked, blocked by the user or lacks the rights.
+func (e *TelegramError) IsForbidden() bool { return e.Code == http.StatusForbidden }
+
+// IsTooLarge reports a file over the server's size limit.
+func (e *TelegramError) IsTooLarge() bool { return e.Code == http.StatusRequestEntityTooLarge }
+
+// IsFlood reports a flood wait; Parameters.RetryAfter says for how long.
+func (e *TelegramError) IsFlood() bool { return e.Code == http.StatusTooManyRequests }
+
+// ResponseParameters explains why a request failed and how to recover.
+type ResponseParameters struct {
+	// RetryAfter is the number of seconds to wait after a flood wait
+	RetryAfter int `json:"retry_after"`
+	// MigrateToChatID is the supergroup a group was upgraded to
+	MigrateToChatID int64 `json:"migrate_to_chat_id"`
+}
+
+// isAudioFile reports whether the file has an audio extension.
+func isAudioFile(path string) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".opus", ".mp3", ".m4a", ".flac", ".wav":
+		return true
+	}
+	return false
+}
+
+// isVideoFile reports whether the file is a video Telegram clients can play
+// inline. Other containers are better off as documents.
+func isVideoFile(path string) bool {
+	return strings.ToLower(filepath.Ext(path)) == ".mp4"
+}
+
+// sendsAsVideo reports whether opts is sent with sendVideo.
+func sendsAsVideo(opts uploadOptions) bool {
+	return !opts.AsDocument && isVideoFile(opts.FilePath)
+}
+
+// waitStable blocks until the file's size and modification time have not
+// changed for d, so a file still being downloaded isn't sent truncated.
+func waitStable(path string, d time.Duration) error {
+	poll := d / 4
+	if poll > time.Second {
+		poll = time.Second
+	}
+
+	var last os.FileInfo
+	stableSince := time.Now()
+	logged := false
+	for {
+		info, err := os.Stat(path)
+		if err != nil {
+			return fmt.Errorf("input file does not exist: %s", path)
+		}
+		if last == nil || info.Size() != last.Size() || !info.ModTime().Equal(last.ModTime()) {
+			if last != nil && !logged {
+				logf("Waiting for %s to stop changing\n", path)
+				logged = true
+			}
+			last = info
+			stableSince = time.Now()
+		} else if time.Since(stableSince) >= d {
+			return nil
+		}
+		time.Sleep(poll)
+	}
+}
+
+// sendsAsAudio reports whether opts is sent with sendAudio, which an audio
+// file is unless it was asked to go out as a document.
+func sendsAsAudio(opts uploadOptions) bool {
+	return !opts.AsDocument && isAudioFile(opts.FilePath)
+}
+
+// paidMediaKind returns the InputPaidMedia type for a file, or "" if it
+// cannot be sent as paid media.
+func paidMediaKind(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".jpg", ".jpeg", ".png", ".webp":
+		return "photo"
+	case ".mp4", ".mov", ".mkv", ".webm":
+		return "video"
+	}
+	return ""
+}
+
+func uploadFile(opts uploadOptions) (result *uploadResult, err error) {
+	uploadSpan := startSpan(nil, "upload")
+	uploadSpan.setAttr("file.path", opts.FilePath)
+	uploadSpan.setAttr("telegram.chat_id", opts.ChatID)
+	defer func() { uploadSpan.finish(err) }()
+
+	// Keep the job as requested for the dead-letter list
+	job := opts
+
 	// Check and wait for delay if specified
-	if err := checkAndWaitForDelay(delaySeconds); err != nil {
-		return 0, err
+	if err := checkAndWaitForDelay(opts.DelaySeconds); err != nil {
+		return nil, err
+	}
+
+	if opts.WaitStable > 0 {
+		if err := waitStable(opts.FilePath, opts.WaitStable); err != nil {
+			return nil, err
+		}
 	}
 
+	probeSpan := startSpan(uploadSpan, "metadata probe")
+
 	// Validate input file exists
-	if _, err := os.Stat(filePath); os.IsNotExist(err) {
-		return 0, fmt.Errorf("input file does not exist: %s", filePath)
+	if _, err := os.Stat(opts.FilePath); os.IsNotExist(err) {
+		err = fmt.Errorf("input file does not exist: %s", opts.FilePath)
+		probeSpan.finish(err)
+		return nil, err
+	}
+	if opts.ThumbnailPath != "" {
+		if _, err := os.Stat(opts.ThumbnailPath); os.IsNotExist(err) {
+			err = fmt.Errorf("thumbnail file does not exist: %s", opts.ThumbnailPath)
+			probeSpan.finish(err)
+			return nil, err
+		}
+	}
+	if opts.PaidStars > 0 && paidMediaKind(opts.FilePath) == "" {
+		err = fmt.Errorf("paid media must be a photo or video: %s", opts.FilePath)
+		probeSpan.finish(err)
+		return nil, err
 	}
+	probeSpan.finish(nil)
 
-	// Determine file type based on extension
-	fileExt := strings.ToLower(filepath.Ext(filePath))
-	isAudio := fileExt == ".opus" || fileExt == ".mp3" || fileExt == ".m4a" || fileExt == ".flac" || fileExt == ".wav"
+	if err := waitForDailyCap(opts.FilePath); err != nil {
+		return nil, err
+	}
+
+	// Branded copies replace the photo and thumbnail; the history still
+	// records the original file
+	opts, watermarkDir, err := applyWatermark(opts)
+	if err != nil {
+		return nil, err
+	}
+	if watermarkDir != "" {
+		defer os.RemoveAll(watermarkDir)
+	}
+
+	// The caption must fit Telegram's limit
+	var followUps []string
+	if caption := messageCaption(opts); caption != "" {
+		opts.Caption, followUps, err = fitCaption(caption, opts.CaptionOverflow, opts.ParseMode)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	backoff := opts.RetryDelay
+	var gatewayStart time.Time
+	transcoded := false
+	gatewayBackoff := opts.RetryDelay
+	if gatewayBackoff <= 0 {
+		gatewayBackoff = time.Second
+	}
 
-	// Choose the right API endpoint
-	endpoint := "sendDocument"
-	if isAudio {
-		endpoint = "sendAudio"
+	// -timeout covers every attempt and the waits between them
+	ctx := context.Background()
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
+	timedOut := func(attempt int, lastErr error) (*uploadResult, error) {
+		err := fmt.Errorf("upload timed out after %v: %v", opts.Timeout, lastErr)
+		if dlqErr := appendDeadLetter(job, attempt, err); dlqErr != nil {
+			logf("Warning: failed to record dead letter: %v\n", dlqErr)
+		}
+		return nil, err
 	}
 
-	file, err := os.Open(filePath)
+	for attempt := 1; ; attempt++ {
+		if err := checkCircuitBreaker(); err != nil {
+			return nil, err
+		}
+
+		attemptSpan := startSpan(uploadSpan, "attempt")
+		attemptSpan.setAttr("attempt", attempt)
+		stopAction := func() {}
+		if opts.ChatAction {
+			stopAction = startChatAction(opts)
+		}
+		result, err = uploadAttempt(ctx, opts, attemptSpan)
+		stopAction()
+		attemptSpan.finish(err)
+		recordBreakerResult(err)
+		if err == nil {
+			break
+		}
+		if ctx.Err() != nil {
+			return timedOut(attempt, err)
+		}
+
+		// A group upgraded to a supergroup lives on under a new ID
+		if newChatID := migratedChat(err); newChatID != 0 && newChatID != opts.ChatID {
+			logf("Chat %d was migrated to %d; sending there instead\n", opts.ChatID, newChatID)
+			if cfgErr := updateMigratedChat(opts.ChatID, newChatID); cfgErr != nil {
+				logf("Warning: failed to update config: %v\n", cfgErr)
+			}
+			opts.ChatID, job.ChatID = newChatID, newChatID
+			attempt--
+			continue
+		}
+
+		// Too large for the server: re-encode smaller once, if configured
+		if isTooLarge(err) && opts.Transcode != "" && !transcoded {
+			output, dir, transcodeErr := transcodeSmaller(opts.Transcode, opts.FilePath)
+			if transcodeErr != nil {
+				logf("Warning: %v\n", transcodeErr)
+			} else {
+				defer os.RemoveAll(dir)
+				logf("%s is too large; retrying with a re-encoded copy\n", opts.FilePath)
+				opts.FilePath, transcoded = output, true
+				attempt--
+				continue
+			}
+		}
+
+		var retryErr *retryableError
+		if errors.As(err, &retryErr) && isGatewayError(retryErr) {
+			if gatewayStart.IsZero() {
+				gatewayStart = time.Now()
+			}
+			if time.Since(gatewayStart) < gatewayRetryWindow {
+				logf("Attempt %d hit a gateway error: %v; retrying in %v\n", attempt, err, gatewayBackoff)
+				if sleepContext(ctx, gatewayBackoff) != nil {
+					return timedOut(attempt, err)
+				}
+				if gatewayBackoff *= 2; gatewayBackoff > gatewayMaxDelay {
+					gatewayBackoff = gatewayMaxDelay
+				}
+				attempt--
+				continue
+			}
+		}
+		if attempt > opts.Retries || !errors.As(err, &retryErr) {
+			if dlqErr := appendDeadLetter(job, attempt, err); dlqErr != nil {
+				logf("Warning: failed to record dead letter: %v\n", dlqErr)
+			}
+			return nil, err
+		}
+
+		wait := backoff
+		if retryErr.after > wait {
+			wait = retryErr.after
+		}
+		logf("Attempt %d failed: %v; retrying in %v\n", attempt, err, wait)
+		if sleepContext(ctx, wait) != nil {
+			return timedOut(attempt, err)
+		}
+		backoff *= 2
+	}
+
+	result.ChatID = opts.ChatID
+	result.Transcoded = transcoded
+	result.Caption = opts.Caption
+	result.FollowUps = followUps
+
+	// Write the last upload timestamp
+	if err := writeLastUploadTime(); err != nil {
+		return nil, fmt.Errorf("failed to write last upload timestamp: %v", err)
+	}
+
+	// The message is already posted, so a history failure is only a warning
+	if err := appendHistory(historyEntry{
+		Time:      time.Now().UTC(),
+		ChatID:    opts.ChatID,
+		MessageID: result.MessageID,
+		File:      job.FilePath,
+		FileName:  uploadFilename(opts),
+		Title:     opts.Title,
+		Performer: opts.Performer,
+		Size:      result.Size,
+		SHA256:    result.SHA256,
+		FileID:    result.FileID,
+		JobID:     opts.JobID,
+		Staged:    opts.PublishChatID != 0,
+	}); err != nil {
+		logf("Warning: failed to record upload history: %v\n", err)
+	}
+
+	if len(followUps) > 0 {
+		if err := sendFollowUps(opts, result.MessageID, followUps); err != nil {
+			logf("Warning: %v\n", err)
+		}
+	}
+
+	return result, nil
+}
+
+// sendTarget returns the Bot API method for a file and the name of the form
+// field carrying it.
+func sendTarget(opts uploadOptions) (endpoint, fieldName string) {
+	switch {
+	case opts.PaidStars > 0:
+		// Paid media is posted through sendPaidMedia with the file attached by name
+		return "sendPaidMedia", "paid_media"
+	case sendsAsAudio(opts):
+		return "sendAudio", "audio"
+	case sendsAsVideo(opts):
+		return "sendVideo", "video"
+	}
+	return "sendDocument", "document"
+}
+
+// messageCaption returns the caption to send: Caption if set, otherwise
+// the title for everything but audio, which shows the title in the player.
+func messageCaption(opts uploadOptions) string {
+	if opts.Caption != "" || sendsAsAudio(opts) {
+		return opts.Caption
+	}
+	return opts.Title
+}
+
+// messageFields returns the form fields describing the message, apart from
+// the file itself. paidMedia is how a paid media entry refers to the file:
+// "attach://<field>" for an upload or a file_id when resending.
+func messageFields(opts uploadOptions, paidMedia string) (map[string]string, error) {
+	// Add common metadata
+	formFields := map[string]string{
+		"chat_id": strconv.FormatInt(opts.ChatID, 10),
+	}
+
+	if opts.ThreadID != 0 {
+		formFields["message_thread_id"] = strconv.Itoa(opts.ThreadID)
+	}
+
+	// Only add a reply if there is a message to reply to
+	if opts.ReplyToMessageID != 0 {
+		for key, value := range replyFields(opts.ReplyToMessageID, opts.AllowSendingWithoutReply) {
+			formFields[key] = value
+		}
+	}
+
+	if opts.ProtectContent {
+		formFields["protect_content"] = "true"
+	}
+
+	// Add parse_mode if provided
+	if opts.ParseMode != "" {
+		formFields["parse_mode"] = opts.ParseMode
+	}
+
+	// Add paid media description, referring to the file via paidMedia
+	if opts.PaidStars > 0 {
+		paidMediaType := paidMediaKind(opts.FilePath)
+		media := map[string]interface{}{
+			"type":  paidMediaType,
+			"media": paidMedia,
+		}
+		if paidMediaType == "video" {
+			if opts.Duration > 0 {
+				media["duration"] = opts.Duration
+			}
+			// A resent file_id keeps its thumbnail; only an upload attaches one
+			if opts.ThumbnailPath != "" && strings.HasPrefix(paidMedia, "attach://") {
+				media["thumbnail"] = "attach://" + thumbnailField()
+			}
+			if !opts.NoStreaming {
+				media["supports_streaming"] = true
+			}
+		}
+		mediaJSON, err := json.Marshal([]interface{}{media})
+		if err != nil {
+			return nil, err
+		}
+		formFields["media"] = string(mediaJSON)
+		formFields["star_count"] = strconv.Itoa(opts.PaidStars)
+	} else if sendsAsAudio(opts) { // Add audio-specific metadata if it's an audio file
+		formFields["title"] = opts.Title
+		formFields["performer"] = opts.Performer
+
+		if opts.Duration > 0 {
+			formFields["duration"] = strconv.Itoa(opts.Duration)
+		}
+
+		if !opts.NoStreaming {
+			formFields["supports_streaming"] = "true"
+		}
+	} else if sendsAsVideo(opts) {
+		if opts.Duration > 0 {
+			formFields["duration"] = strconv.Itoa(opts.Duration)
+		}
+		if !opts.NoStreaming {
+			formFields["supports_streaming"] = "true"
+		}
+	} else if opts.AsDocument {
+		// Keep the server from turning a forced document back into audio
+		formFields["disable_content_type_detection"] = "true"
+	}
+
+	if caption := messageCaption(opts); caption != "" {
+		formFields["caption"] = caption
+	}
+
+	return formFields, nil
+}
+
+// uploadAttempt performs one HTTP upload of the file described by opts.
+func uploadAttempt(ctx context.Context, opts uploadOptions, parentSpan *span) (*uploadResult, error) {
+	// Determine file type based on extension
+	fileExt := strings.ToLower(filepath.Ext(opts.FilePath))
+	isAudio := sendsAsAudio(opts)
+	endpoint, fieldName := sendTarget(opts)
+
+	file, err := os.Open(opts.FilePath)
 	if err != nil {
-		return 0, fmt.Errorf("failed to open file: %v", err)
+		return nil, fmt.Errorf("failed to open file: %v", err)
 	}
 	defer file.Close()
 
+	hasher := sha256.New()
+	var size int64
+
 	// Create a pipe to connect the file reader to the form writer
 	pr, pw := io.Pipe()
 
@@ -110,8 +946,12 @@ func uploadFile(botToken, filePath, title, performer, thumbnailPath string,
 	multipartWriter := multipart.NewWriter(pw)
 
 	// Start a goroutine to write the file data to the pipe
+	encoded := make(chan struct{})
 	go func() {
+		defer close(encoded)
+
 		var writeErr error
+		encodeSpan := startSpan(parentSpan, "multipart encode")
 
 		defer func() {
 			// Close the multipart writer first to finalize the form
@@ -121,13 +961,17 @@ func uploadFile(botToken, filePath, title, performer, thumbnailPath string,
 
 			// Close the pipe writer, propagating any error
 			pw.CloseWithError(writeErr)
+			encodeSpan.finish(writeErr)
 		}()
 
 		// Add file with proper field name
-		fieldName := "document"
 		fileContentType := "application/octet-stream" // Default content type for documents
 
-		if isAudio {
+		if opts.PaidStars > 0 || sendsAsVideo(opts) {
+			if guessed := mime.TypeByExtension(fileExt); guessed != "" {
+				fileContentType = guessed
+			}
+		} else if isAudio {
 			fieldName = "audio"
 			// Explicitly set content type for audio files, especially for .opus
 			// Common audio types: audio/mpeg (for mp3), audio/ogg (for opus, ogg vorbis), audio/aac, etc.
@@ -149,11 +993,16 @@ func uploadFile(botToken, filePath, title, performer, thumbnailPath string,
 			}
 		}
 
+		// An explicit MIME type wins over the extension-based guess
+		if opts.MimeType != "" {
+			fileContentType = opts.MimeType
+		}
+
 		// Create the form file part for the audio/document
 		// Use CreatePart instead of CreateFormFile to manually set Content-Type header
 		h := make(textproto.MIMEHeader)
 		h.Set("Content-Disposition",
-			fmt.Sprintf(`form-data; name="%s"; filename="%s"`, fieldName, filepath.Base(filePath)))
+			fmt.Sprintf(`form-data; name="%s"; filename="%s"`, fieldName, uploadFilename(opts)))
 		h.Set("Content-Type", fileContentType) // Explicitly set Content-Type for the part
 
 		fileWriter, err := multipartWriter.CreatePart(h)
@@ -162,38 +1011,29 @@ func uploadFile(botToken, filePath, title, performer, thumbnailPath string,
 			return
 		}
 
-		// Copy file data
-		if _, writeErr = io.Copy(fileWriter, file); writeErr != nil {
-			return
+		// Copy file data, hashing it on the way for the upload history
+		var fileReader io.Reader = file
+		if opts.Tail > 0 {
+			fileReader = newTailReader(file, opts.FilePath, opts.Tail)
 		}
-
-		// Add common metadata
-		formFields := map[string]string{
-			"chat_id": strconv.FormatInt(chatID, 10),
-		}
-
-		// Only add reply_to_message_id if it's not 0
-		if replyToMessageID != 0 {
-			formFields["reply_to_message_id"] = strconv.Itoa(replyToMessageID)
+		var source io.Reader = io.TeeReader(fileReader, hasher)
+		if opts.Progress != nil {
+			if info, err := file.Stat(); err == nil {
+				source = &progressReader{r: source, total: info.Size(), report: opts.Progress}
+			}
 		}
-
-		// Add parse_mode if provided
-		if parseMode != "" {
-			formFields["parse_mode"] = parseMode
+		buf := getCopyBuffer()
+		size, writeErr = io.CopyBuffer(fileWriter, source, *buf)
+		copyBuffers.Put(buf)
+		if writeErr != nil {
+			return
 		}
 
-		// Add audio-specific metadata if it's an audio file
-		if isAudio {
-			formFields["title"] = title
-			formFields["performer"] = performer
-
-			if duration > 0 {
-				formFields["duration"] = strconv.Itoa(duration)
-			}
-
-			formFields["supports_streaming"] = "true"
-		} else if title != "" { // For documents, use caption instead of title
-			formFields["caption"] = title
+		// Add message metadata; paid media references the file part by name
+		formFields, err := messageFields(opts, "attach://"+fieldName)
+		if err != nil {
+			writeErr = err
+			return
 		}
 
 		for key, value := range formFields {
@@ -204,21 +1044,17 @@ func uploadFile(botToken, filePath, title, performer, thumbnailPath string,
 		}
 
 		// Add thumbnail if provided
-		if thumbnailPath != "" {
-			if _, err := os.Stat(thumbnailPath); os.IsNotExist(err) {
-				writeErr = fmt.Errorf("thumbnail file does not exist: %s", thumbnailPath)
-				return
-			}
-
-			thumbnailFile, err := os.Open(thumbnailPath)
+		if opts.ThumbnailPath != "" {
+			thumbnailFile, err := os.Open(opts.ThumbnailPath)
 			if err != nil {
 				writeErr = err
 				return
 			}
 			defer thumbnailFile.Close()
 
-			// For thumbnail, CreateFormFile is usually fine as Content-Type for images is standard
-			thumbPart, err := multipartWriter.CreateFormFile("thumb", filepath.Base(thumbnailPath))
+			// For thumbnail, CreateFormFile is usually fine as Content-Type for images is standard.
+			// sendAudio, sendDocument and sendVideo all take it as "thumbnail" ("thumb" before 6.6).
+			thumbPart, err := multipartWriter.CreateFormFile(thumbnailField(), filepath.Base(opts.ThumbnailPath))
 			if err != nil {
 				writeErr = err
 				return
@@ -231,100 +1067,754 @@ func uploadFile(botToken, filePath, title, performer, thumbnailPath string,
 	}()
 
 	// Create and send HTTP request
-	url := fmt.Sprintf("%s%s/%s", telegramAPIURL, botToken, endpoint)
-	req, err := http.NewRequest("POST", url, pr)
+	req, err := http.NewRequestWithContext(ctx, "POST", methodURL(opts.BotToken, endpoint), pr)
 	if err != nil {
-		return 0, fmt.Errorf("failed to create request: %v", err)
+		return nil, fmt.Errorf("failed to create request: %v", err)
 	}
 	req.Header.Set("Content-Type", multipartWriter.FormDataContentType())
 
-	// Set a longer timeout for large uploads
-	client := &http.Client{
-		Timeout: 10 * time.Minute,
+	// Set a longer timeout for large uploads. A tailed file takes as long
+	// as whatever is writing it, so it gets none.
+	timeout := 10 * time.Minute
+	if opts.Tail > 0 {
+		timeout = 0
 	}
+	client := httpClient(timeout)
+
+	httpSpan := startSpan(parentSpan, "http request")
+	httpSpan.setAttr("http.method", "POST")
+	httpSpan.setAttr("telegram.method", endpoint)
 
 	// Send the request
 	resp, err := client.Do(req)
 	if err != nil {
-		return 0, fmt.Errorf("failed to send request: %v", err)
+		err = &retryableError{err: fmt.Errorf("failed to send request: %v", err)}
+		httpSpan.finish(err)
+		return nil, err
 	}
 	defer resp.Body.Close()
+	httpSpan.setAttr("http.status_code", resp.StatusCode)
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		err = &retryableError{err: fmt.Errorf("failed to read response: %v", err)}
+		httpSpan.finish(err)
+		return nil, err
+	}
 
 	// Decode response and return message ID
 	var result TelegramResponse
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+	if err := json.Unmarshal(body, &result); err != nil {
 		// Log the raw response body for debugging if decoding fails
-		bodyBytes, _ := io.ReadAll(resp.Body)
-		fmt.Fprintf(os.Stderr, "Failed to decode response. Raw body: %s\n", string(bodyBytes))
-		return 0, fmt.Errorf("failed to decode response: %v", err)
+		logf("Failed to decode response. Raw body: %s\n", string(body))
+		err = decodeError(resp, body, err)
+		if resp.StatusCode >= 500 || gatewayCodes[resp.StatusCode] {
+			err = &retryableError{err: err, status: resp.StatusCode}
+		}
+		httpSpan.finish(err)
+		return nil, err
 	}
 
 	if !result.OK {
-		return 0, fmt.Errorf("telegram API error: %s", result.Description)
+		err = &TelegramError{
+			Code:        result.ErrorCode,
+			Description: result.Description,
+			Parameters:  result.Parameters,
+		}
+		if result.ErrorCode == http.StatusTooManyRequests || result.ErrorCode >= 500 || gatewayCodes[result.ErrorCode] {
+			err = &retryableError{
+				err:    err,
+				after:  time.Duration(result.Parameters.RetryAfter) * time.Second,
+				status: result.ErrorCode,
+			}
+		}
+		httpSpan.finish(err)
+		return nil, err
 	}
+	httpSpan.finish(nil)
 
-	// Write the last upload timestamp
-	if err := writeLastUploadTime(); err != nil {
-		return 0, fmt.Errorf("failed to write last upload timestamp: %v", err)
+	// The server accepted the whole form, so the encoder is finishing up and
+	// size and hash are complete
+	<-encoded
+	uploaded := &uploadResult{
+		MessageID:  result.Result.MessageID,
+		FileID:     result.fileID(),
+		SHA256:     hex.EncodeToString(hasher.Sum(nil)),
+		Size:       size,
+		StoredSize: result.fileSize(),
+		Date:       result.Result.Date,
+	}
+	if file := result.media(); file != nil {
+		uploaded.FileUniqueID = file.FileUniqueID
+	}
+	var envelope struct {
+		Result json.RawMessage `json:"result"`
+	}
+	if json.Unmarshal(body, &envelope) == nil {
+		uploaded.Message = envelope.Result
+	}
+	return uploaded, nil
+}
+
+// errorSnippetLength is how much of an undecodable response body goes
+// into the error.
+const errorSnippetLength = 200
+
+// decodeError describes a response that isn't Bot API JSON, typically an
+// HTML error page from a proxy or load balancer (413, 502), by its status
+// and the start of its body.
+func decodeError(resp *http.Response, body []byte, err error) error {
+	snippet := strings.Join(strings.Fields(string(body)), " ")
+	if len(snippet) > errorSnippetLength {
+		snippet = strings.ToValidUTF8(snippet[:errorSnippetLength], "") + "..."
+	}
+	if snippet == "" {
+		return &httpError{status: resp.StatusCode, err: fmt.Errorf("failed to decode response: HTTP %s with empty body", resp.Status)}
+	}
+	return &httpError{status: resp.StatusCode, err: fmt.Errorf("failed to decode response: HTTP %s: %v; body: %q", resp.Status, err, snippet)}
+}
+
+// callAPI invokes a Bot API method with form-encoded parameters and returns
+// the raw "result" field of the response.
+func callAPI(botToken, method string, params url.Values) (json.RawMessage, error) {
+	client := httpClient(30 * time.Second)
+
+	resp, err := client.PostForm(methodURL(botToken, method), params)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		OK          bool               `json:"ok"`
+		ErrorCode   int                `json:"error_code"`
+		Description string             `json:"description"`
+		Result      json.RawMessage    `json:"result"`
+		Parameters  ResponseParameters `json:"parameters"`
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %v", err)
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return nil, decodeError(resp, body, err)
+	}
+
+	if !result.OK {
+		var err error = &TelegramError{
+			Code:        result.ErrorCode,
+			Description: result.Description,
+			Parameters:  result.Parameters,
+		}
+		if result.ErrorCode == http.StatusTooManyRequests {
+			err = &retryableError{err: err, after: time.Duration(result.Parameters.RetryAfter) * time.Second}
+		}
+		return nil, err
 	}
 
-	return result.Result.MessageID, nil
+	return result.Result, nil
+}
+
+// setReaction marks a message with an emoji reaction via setMessageReaction.
+func setReaction(botToken string, chatID int64, messageID int, emoji string) error {
+	reaction, err := json.Marshal([]map[string]string{{"type": "emoji", "emoji": emoji}})
+	if err != nil {
+		return err
+	}
+
+	_, err = callAPI(botToken, "setMessageReaction", url.Values{
+		"chat_id":    {strconv.FormatInt(chatID, 10)},
+		"message_id": {strconv.Itoa(messageID)},
+		"reaction":   {string(reaction)},
+	})
+	return err
+}
+
+// notifyFailure sends a short failure report to an admin chat.
+func notifyFailure(botToken, chat string, opts uploadOptions, uploadErr error) error {
+	host, _ := os.Hostname()
+	text := fmt.Sprintf("Upload failed on %s\nFile: %s\nChat: %d\nError: %v",
+		host, opts.FilePath, opts.ChatID, uploadErr)
+	if utf16Len(text) > messageLimit {
+		text, _ = splitText(text, messageLimit)
+	}
+
+	_, err := callAPI(botToken, "sendMessage", url.Values{
+		"chat_id": {chat},
+		"text":    {text},
+	})
+	return err
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: uploader [flags] -token <bot_token> -chat <chat_id> -file <file_path> [-title t] [-performer p] [-duration s] [-reply-to id]\n")
+	fmt.Fprintf(os.Stderr, "       uploader [flags] [-legacy-args] <bot_token> <chat_id> <file_path> <title> <performer> <duration> <reply_to_message_id> [thumbnail_path] [parse_mode] [delay_seconds]   (deprecated)\n")
+	fmt.Fprintf(os.Stderr, "       uploader health [connection flags] <bot_token> [max_age_seconds]\n")
+	fmt.Fprintf(os.Stderr, "       uploader speedtest [connection flags] <bot_token> <chat_id> [size_mib]\n")
+	fmt.Fprintf(os.Stderr, "       uploader history list|search|export|prune [flags]\n")
+	fmt.Fprintf(os.Stderr, "       uploader deadletter list|retry|notify|clear [args]\n")
+	fmt.Fprintf(os.Stderr, "       uploader config show|set-owner|alias|topic|validate [args]\n")
+	fmt.Fprintf(os.Stderr, "       uploader stats [-since age] [-by day,chat] [-chat id]\n")
+	fmt.Fprintf(os.Stderr, "       uploader status <job_id>\n")
+	fmt.Fprintf(os.Stderr, "       uploader import-history [-chat id] <result.json>\n")
+	fmt.Fprintf(os.Stderr, "       uploader mirror [-from id -to id] <bot_token> <source_chat> <destination_chat>\n")
+	fmt.Fprintf(os.Stderr, "       uploader bench [-sizes 1M,10M] [-runs n] <bot_token> <chat_id>\n")
+	fmt.Fprintf(os.Stderr, "       uploader ledger verify <ledger_file>\n")
+	fmt.Fprintf(os.Stderr, "       uploader preview [-caption tmpl] [-parse-mode mode] <file_path> <title> <performer> [duration]\n")
+	fmt.Fprintf(os.Stderr, "       uploader stdio [-concurrency n] [bot_token]   (JSON jobs on stdin, results on stdout)\n")
+	fmt.Fprintf(os.Stderr, "\nchat_id may be an alias from \"uploader config alias\", or \"self\" for the owner chat set with \"uploader config set-owner\";\n")
+	fmt.Fprintf(os.Stderr, "with -to-self it is left out altogether.\n")
+	fmt.Fprintf(os.Stderr, "\nThe config's \"chats\" section sets defaults per chat ID or alias: parse_mode, delay_seconds,\n")
+	fmt.Fprintf(os.Stderr, "caption, protect_content and topic apply unless given as arguments or flags.\n")
+	fmt.Fprintf(os.Stderr, "\nFlags:\n")
+	flag.PrintDefaults()
 }
 
 func main() {
-	if len(os.Args) < 8 {
-		fmt.Fprintf(os.Stderr, "Usage: uploader <bot_token> <chat_id> <file_path> <title> <performer> <duration> <reply_to_message_id> [thumbnail_path] [parse_mode] [delay_seconds]\n")
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "health":
+			os.Exit(runHealth(os.Args[2:]))
+		case "speedtest":
+			os.Exit(runSpeedtest(os.Args[2:]))
+		case "history":
+			os.Exit(runHistory(os.Args[2:]))
+		case "deadletter":
+			os.Exit(runDeadLetter(os.Args[2:]))
+		case "config":
+			os.Exit(runConfig(os.Args[2:]))
+		case "stats":
+			os.Exit(runStats(os.Args[2:]))
+		case "status":
+			os.Exit(runStatus(os.Args[2:]))
+		case "import-history":
+			os.Exit(runImportHistory(os.Args[2:]))
+		case "mirror":
+			os.Exit(runMirror(os.Args[2:]))
+		case "bench":
+			os.Exit(runBench(os.Args[2:]))
+		case "ledger":
+			os.Exit(runLedger(os.Args[2:]))
+		case "preview":
+			os.Exit(runPreview(os.Args[2:]))
+		case "stdio":
+			os.Exit(runStdio(os.Args[2:]))
+		}
+	}
+
+	addConnectionFlags(flag.CommandLine)
+	logFilePath := flag.String("log-file", "", "also write diagnostics to this file")
+	logMaxSize := flag.Int64("log-max-size", 10, "rotate the log file once it exceeds this many MiB (0 disables)")
+	logRotateEvery := flag.Duration("log-rotate-every", 0, "rotate the log file when this interval rolls over, e.g. 24h (0 disables)")
+	logMaxBackups := flag.Int("log-max-backups", 5, "number of rotated log files to keep")
+	retries := flag.Int("retries", 0, "extra attempts after a network error, 5xx or flood wait")
+	retryDelay := flag.Duration("retry-delay", 5*time.Second, "wait before the first retry, doubling after each attempt")
+	flag.StringVar(&ledgerPath, "ledger", "", "append a hash-chained record of every post to this file (HMAC-keyed with $"+ledgerKeyEnv+" if set); check it with \"uploader ledger verify\"")
+	flag.Var(gatewayCodes, "gateway-codes", "HTTP statuses retried as transient gateway errors within -gateway-retry-window, without using up -retries")
+	flag.DurationVar(&gatewayRetryWindow, "gateway-retry-window", 5*time.Minute, "how long to keep retrying gateway errors (0 treats them like other failures)")
+	flag.IntVar(&breakerThreshold, "breaker-threshold", 0, "consecutive failed requests that open the circuit breaker (0 disables)")
+	flag.DurationVar(&breakerCooldown, "breaker-cooldown", 10*time.Minute, "how long an open circuit breaker rejects uploads")
+	flag.StringVar(&captionLocale, "caption-locale", "en", "locale for humanSize in -caption templates: en, de, es, fr, it, nl, pt, ru or uk")
+	autoThumb := flag.String("auto-thumbnail", "", "thumbnail for documents sent without one: \"badge\" draws the file extension, anything else is a shell command writing a JPEG to $UPLOADER_THUMBNAIL for $UPLOADER_FILE")
+	captionTemplate := flag.String("caption", "", "caption as a Go template instead of the title, e.g. '{{.Performer}} - {{.Title}} ({{.SizeHuman}})'; fields: Title, Performer, Duration, FileName, Ext, Size, SizeHuman; functions: humanSize, humanDuration")
+	captionOverflow := flag.String("caption-overflow", overflowTruncate, "what to do with captions over 1024 characters: truncate, followup or error")
+	paidStars := flag.Int("paid-stars", 0, "post a photo or video as paid media unlocked for this many Telegram Stars")
+	asDocument := flag.Bool("as-document", false, "send audio and video files as documents instead of through the player, e.g. for lossless archives")
+	streaming := flag.Bool("streaming", true, "mark audio and video as suitable for streaming (-streaming=false leaves supports_streaming unset)")
+	mimeType := flag.String("mime-type", "", "Content-Type for the uploaded file part, e.g. application/x-cbz (default: guessed from the extension)")
+	normalizeFilename := flag.Bool("normalize-filename", false, "compose decomposed (NFD) accented letters in the uploaded filename")
+	transliterateFilename := flag.Bool("transliterate-filename", false, "transliterate accented Latin, Cyrillic and Greek letters in the uploaded filename to ASCII")
+	sanitizeFilename := flag.Bool("sanitize-filename", false, "strip control, invisible and reserved characters from the uploaded filename")
+	cleanRules := flag.String("clean-metadata", "", "tidy title and performer before sending: comma-separated space, caps, noise, or all")
+	var stripPatterns stringList
+	flag.Var(&stripPatterns, "strip-pattern", "regular expression to remove from title and performer (repeatable)")
+	allowWithoutReply := flag.Bool("allow-sending-without-reply", false, "still post the file if the reply_to_message_id message was deleted")
+	topic := flag.String("topic", "", "forum topic to post in, by thread ID or by a name created with -create-topic or recorded with \"uploader config topic\"")
+	protectContent := flag.Bool("protect-content", false, "stop the message from being forwarded or saved")
+	watermark := flag.String("watermark", "", "logo image (JPEG or PNG) to draw onto photos sent as paid media and onto video thumbnails")
+	watermarkCommand := flag.String("watermark-command", "", "shell command that watermarks $UPLOADER_FILE into $UPLOADER_OUTPUT instead of the built-in overlay; -watermark is passed as $UPLOADER_WATERMARK")
+	watermarkPosition := flag.String("watermark-position", "bottom-right", "where to draw the -watermark: "+strings.Join(watermarkPositions, ", "))
+	watermarkOpacity := flag.Float64("watermark-opacity", 0.8, "opacity of the -watermark, from 0 to 1")
+	createTopic := flag.Bool("create-topic", false, "create the -topic with createForumTopic if no topic of that name is known")
+	uploadTimeout := flag.Duration("timeout", 0, "give up on the upload, retries included, after this long, e.g. 2h for a large archive (the -delay wait doesn't count)")
+	flag.StringVar(&tmpDir, "tmp-dir", "", "directory for the scratch copies made by -transcode-413 and -watermark (default: work in the state directory)")
+	transcode413 := flag.String("transcode-413", "", "shell command that re-encodes $UPLOADER_FILE smaller into $UPLOADER_OUTPUT, run once if Telegram rejects the file as too large (413)")
+	tailIdle := flag.Duration("tail", 0, "upload a file that is still being written as it grows; it is complete once it hasn't grown for this long or <file>.done exists, e.g. 30s")
+	waitStableFor := flag.Duration("wait-stable", 0, "wait until the file's size and mtime have been unchanged this long before uploading, e.g. 10s")
+	replyLast := flag.Bool("reply-last", false, "reply to the last message this tool posted to the chat, from the upload history")
+	var alsoToFlags stringList
+	flag.Var(&alsoToFlags, "also-to", "comma-separated chat IDs to also send the file to by file_id after uploading it once (repeatable)")
+	fanOutConcurrency := flag.Int("fan-out-concurrency", 4, "how many -also-to chats to send to at once")
+	showChatAction := flag.Bool("chat-action", false, "show the \"sending file...\" indicator in the chat while the upload runs")
+	stagingChatFlag := flag.String("staging-chat", "", "upload to this private chat first and copy the message to the real chat only once it checks out")
+	showStatus := flag.Bool("status-message", false, "post a progress message in the chat while a slow upload runs, deleted once it is done")
+	jsonOutput := flag.Bool("json", false, "print one JSON object per destination chat on stdout as each finishes, instead of the message ID")
+	jsonMessage := flag.Bool("json-message", false, "with -json, include the sent message exactly as Telegram returned it")
+	progressFormat := flag.String("progress", "", "emit progress events while uploading; \"json\" writes one JSON object per line")
+	progressFD := flag.Int("progress-fd", 2, "file descriptor for -progress events (1 = stdout, 2 = stderr)")
+	progressInterval := flag.Duration("progress-interval", time.Second, "minimum time between -progress events")
+	skipExisting := flag.Bool("skip-existing", false, "don't upload a file the history shows was already sent to the chat; print the earlier message ID instead")
+	checkPerms := flag.Bool("check-permissions", false, "verify with getChat/getChatMember that the bot may post this file to every target chat, and into the -topic, before uploading")
+	jobID := flag.String("job-id", "", "ID to record this upload under for \"uploader status\"; rerunning a job that already posted prints its message ID instead of uploading again (default: random)")
+	notifyChat := flag.String("notify-chat", "", "chat ID to send a short error report to when the upload fails")
+	reaction := flag.String("reaction", "", "emoji reaction to set on the uploaded message, e.g. 🔥")
+	preHook := flag.String("pre-hook", "", "shell command run before the upload; a non-zero exit aborts it")
+	postHook := flag.String("post-hook", "", "shell command run after the upload, successful or not")
+	dailyCapFlag := flag.String("daily-cap", "", "pause uploads once this much was uploaded today, e.g. 2G (resumes after midnight)")
+	flag.IntVar(&historyMaxEntries, "history-max-entries", 0, "trim the upload history to this many most recently uploaded or looked up entries (0 = unlimited)")
+	otlpEndpoint := flag.String("otlp-endpoint", "", "export OpenTelemetry spans to this OTLP/HTTP traces URL (defaults to $OTEL_EXPORTER_OTLP_ENDPOINT)")
+	flag.BoolVar(&quiet, "quiet", false, "print only the result on stdout and errors on stderr, no progress messages or warnings")
+	silent := flag.Bool("silent", false, "print nothing at all; only the exit code tells the outcome")
+	namedArgs := addUploadArgFlags()
+	flag.Usage = usage
+	flag.Parse()
+
+	setFlags := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { setFlags[f.Name] = true })
+
+	if *silent {
+		// Nothing but the exit code: drop the result and every diagnostic,
+		// including what hooks print. -log-file still records them.
+		if devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0); err == nil {
+			os.Stdout, os.Stderr = devNull, devNull
+		}
+	}
+
+	args, legacy, err := namedArgs.positional(flag.Args(), setFlags)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n\n", err)
+		usage()
+		os.Exit(1)
+	}
+	if legacy {
+		if len(args) < 7 {
+			usage()
+			os.Exit(1)
+		}
+		logf("Warning: positional arguments are deprecated; use -token, -chat, -file, -title, -performer, -duration, -reply-to, -thumbnail, -parse-mode and -delay instead\n")
+	}
+
+	if *logFilePath != "" {
+		rotating, err := openRotatingFile(*logFilePath, *logMaxSize<<20, *logRotateEvery, *logMaxBackups)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid log file: %v\n", err)
+			os.Exit(1)
+		}
+		defer rotating.Close()
+		logFile = rotating
+	}
+
+	if err := setupTransport(); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid connection settings: %v\n", err)
+		os.Exit(1)
+	}
+
+	if err := checkStateDir(); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
 		os.Exit(1)
 	}
 
-	botToken := os.Args[1]
+	if *dailyCapFlag != "" {
+		var err error
+		if dailyCap, err = parseSize(*dailyCapFlag); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid -daily-cap: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	initTracing(*otlpEndpoint)
 
-	chatID, err := strconv.ParseInt(os.Args[2], 10, 64)
+	botToken := args[0]
+
+	if err := detectAPIVersion(botToken); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+
+	chatID, err := resolveChatID(cfg, args[1])
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Invalid chat ID: %v\n", err)
 		os.Exit(1)
 	}
 
-	filePath := os.Args[3]
-	title := os.Args[4]
-	performer := os.Args[5]
+	alsoTo, err := parseChatList(cfg, alsoToFlags)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid -also-to: %v\n", err)
+		os.Exit(1)
+	}
+
+	var stagingChat int64
+	if *stagingChatFlag != "" {
+		if stagingChat, err = resolveChatID(cfg, *stagingChatFlag); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid -staging-chat: %v\n", err)
+			os.Exit(1)
+		}
+		if *captionOverflow == overflowFollowUp {
+			fmt.Fprintf(os.Stderr, "-caption-overflow followup can't be used with -staging-chat: the follow-ups would stay in the staging chat\n")
+			os.Exit(1)
+		}
+	}
+
+	filePath := args[2]
+	title := args[3]
+	performer := args[4]
+
+	if *cleanRules != "" || len(stripPatterns) > 0 {
+		cleaner, err := newMetadataCleaner(*cleanRules, stripPatterns)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid metadata cleanup: %v\n", err)
+			os.Exit(1)
+		}
+		title = cleaner.clean(title)
+		performer = cleaner.clean(performer)
+	}
 
-	duration, err := strconv.Atoi(os.Args[6])
+	duration, err := strconv.Atoi(args[5])
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Invalid duration: %v\n", err)
 		os.Exit(1)
 	}
 
-	replyToMessageID, err := strconv.Atoi(os.Args[7])
+	replyToMessageID, err := strconv.Atoi(args[6])
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Invalid reply_to_message_id: %v\n", err)
 		os.Exit(1)
 	}
 
+	if *replyLast {
+		if replyToMessageID != 0 {
+			fmt.Fprintf(os.Stderr, "-reply-last and a reply_to_message_id cannot be combined\n")
+			os.Exit(1)
+		}
+		if replyToMessageID, err = lastMessageID(chatID); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+		if replyToMessageID == 0 {
+			logf("Warning: no earlier upload to chat %d in the history; posting without a reply\n", chatID)
+		}
+	}
+
 	thumbnailPath := ""
-	if len(os.Args) > 8 {
-		thumbnailPath = os.Args[8]
+	if len(args) > 7 {
+		thumbnailPath = args[7]
 	}
 
 	parseMode := ""
-	if len(os.Args) > 9 {
-		parseMode = os.Args[9]
+	if len(args) > 8 {
+		parseMode = args[8]
 	}
 
 	delaySeconds := 0
-	if len(os.Args) > 10 {
-		delaySeconds, err = strconv.Atoi(os.Args[10])
+	if len(args) > 9 {
+		delaySeconds, err = strconv.Atoi(args[9])
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Invalid delay_seconds: %v\n", err)
 			os.Exit(1)
 		}
 	}
 
-	messageID, err := uploadFile(botToken, filePath, title, performer, thumbnailPath, chatID, duration, replyToMessageID, parseMode, delaySeconds)
+	// The chat's configured conventions fill in whatever wasn't given
+	defaults := cfg.defaultsFor(chatID)
+	if parseMode == "" {
+		parseMode = defaults.ParseMode
+	}
+	if len(args) <= 9 {
+		delaySeconds = defaults.DelaySeconds
+	}
+	if !setFlags["caption"] {
+		*captionTemplate = defaults.Caption
+	}
+	if !setFlags["protect-content"] {
+		*protectContent = defaults.ProtectContent
+	}
+	if !setFlags["topic"] {
+		*topic = defaults.Topic
+	}
+
+	// A caller retrying with the same -job-id gets the earlier result back
+	// instead of a second copy of the file
+	var existing *historyEntry
+	if *jobID != "" {
+		if existing, err = findJob(*jobID); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+	} else {
+		*jobID = newJobID()
+	}
+
+	opts := uploadOptions{
+		BotToken:         botToken,
+		JobID:            *jobID,
+		ChatID:           chatID,
+		FilePath:         filePath,
+		Title:            title,
+		Performer:        performer,
+		Duration:         duration,
+		ReplyToMessageID: replyToMessageID,
+		ThumbnailPath:    thumbnailPath,
+		ParseMode:        parseMode,
+		DelaySeconds:     delaySeconds,
+		Retries:          *retries,
+		RetryDelay:       *retryDelay,
+		CaptionOverflow:  *captionOverflow,
+		PaidStars:        *paidStars,
+		MimeType:         *mimeType,
+		AsDocument:       *asDocument,
+		NoStreaming:      !*streaming,
+
+		NormalizeFilename:     *normalizeFilename,
+		TransliterateFilename: *transliterateFilename,
+		SanitizeFilename:      *sanitizeFilename,
+
+		AllowSendingWithoutReply: *allowWithoutReply,
+		WaitStable:               *waitStableFor,
+		ChatAction:               *showChatAction,
+		Tail:                     *tailIdle,
+		Transcode:                *transcode413,
+		Timeout:                  *uploadTimeout,
+		ProtectContent:           *protectContent,
+
+		Watermark:         *watermark,
+		WatermarkCommand:  *watermarkCommand,
+		WatermarkPosition: *watermarkPosition,
+		WatermarkOpacity:  *watermarkOpacity,
+	}
+
+	// Documents without artwork can get a generated thumbnail
+	if endpoint, _ := sendTarget(opts); *autoThumb != "" && opts.ThumbnailPath == "" && endpoint == "sendDocument" {
+		if opts.ThumbnailPath, err = autoThumbnail(*autoThumb, filePath); err != nil {
+			logf("Warning: failed to generate thumbnail: %v\n", err)
+			opts.ThumbnailPath = ""
+		}
+	}
+
+	if opts.Tail > 0 && opts.WaitStable > 0 {
+		fmt.Fprintf(os.Stderr, "-tail and -wait-stable are mutually exclusive\n")
+		os.Exit(1)
+	}
+
+	if opts.Watermark != "" || opts.WatermarkCommand != "" {
+		if opts.Tail > 0 {
+			fmt.Fprintf(os.Stderr, "-watermark needs the whole image and can't be used with -tail\n")
+			os.Exit(1)
+		}
+		known := false
+		for _, position := range watermarkPositions {
+			known = known || opts.WatermarkPosition == position
+		}
+		if !known || opts.WatermarkOpacity <= 0 || opts.WatermarkOpacity > 1 {
+			fmt.Fprintf(os.Stderr, "Invalid -watermark-position or -watermark-opacity\n")
+			os.Exit(1)
+		}
+	}
+
+	if _, ok := numberLocales[captionLocale]; !ok {
+		fmt.Fprintf(os.Stderr, "Invalid -caption-locale %q\n", captionLocale)
+		os.Exit(1)
+	}
+	if *captionTemplate != "" {
+		if opts.Caption, err = renderCaption(*captionTemplate, opts); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid -caption: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if existing == nil && *skipExisting {
+		if existing, err = findUploaded(chatID, filePath, uploadFilename(opts)); err != nil {
+			errorf("Error uploading file: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if existing != nil && existing.Staged {
+		// An earlier run staged the file but didn't get to publish it
+		if *topic != "" {
+			if opts.ThreadID, err = resolveTopic(botToken, chatID, *topic, *createTopic); err != nil {
+				errorf("Error uploading file: %v\n", err)
+				os.Exit(1)
+			}
+		}
+		opts.PublishChatID, opts.PublishReplyTo, opts.PublishThreadID = opts.ChatID, opts.ReplyToMessageID, opts.ThreadID
+		messageID, err := publishStaged(opts, stagedUpload(existing))
+		if err != nil {
+			errorf("Error uploading file: %v\n", err)
+			os.Exit(1)
+		}
+		logf("Published staged message %d to chat %d\n", existing.MessageID, opts.PublishChatID)
+		existing = &historyEntry{ChatID: opts.PublishChatID, MessageID: messageID, FileID: existing.FileID}
+	} else if existing != nil {
+		logf("Already in chat %d as message %d; skipping\n", existing.ChatID, existing.MessageID)
+	}
+	if existing != nil {
+		if *jsonOutput {
+			line, _ := json.Marshal(resultRecord{JobID: opts.JobID, ChatID: existing.ChatID, File: filePath,
+				MessageID: existing.MessageID, FileID: existing.FileID})
+			fmt.Println(string(line))
+		} else {
+			fmt.Println(existing.MessageID)
+		}
+		return
+	}
+
+	// Checked before -create-topic runs, so a bot that can't post leaves
+	// no empty topic behind
+	if *checkPerms {
+		targets := append([]int64{chatID}, alsoTo...)
+		if stagingChat != 0 {
+			targets = append(targets, stagingChat)
+		}
+		for _, target := range targets {
+			// Only the main chat posts into the -topic
+			targetTopic := ""
+			if target == chatID {
+				targetTopic = *topic
+			}
+			if err := checkPermissions(opts, target, targetTopic, *createTopic); err != nil {
+				errorf("Error uploading file: %v\n", err)
+				os.Exit(1)
+			}
+		}
+	}
+
+	if *topic != "" {
+		if opts.ThreadID, err = resolveTopic(botToken, chatID, *topic, *createTopic); err != nil {
+			errorf("Error uploading file: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if *preHook != "" {
+		if err := runHook(*preHook, opts, 0, nil); err != nil {
+			errorf("Error uploading file: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	// With a staging chat the file is uploaded there and only copied to the
+	// real chat once it checks out; progress goes to the staging chat too
+	if stagingChat != 0 {
+		opts.PublishChatID, opts.PublishReplyTo, opts.PublishThreadID = opts.ChatID, opts.ReplyToMessageID, opts.ThreadID
+		opts.ChatID, opts.ReplyToMessageID, opts.ThreadID = stagingChat, 0, 0
+	}
+
+	var progressFuncs []func(sent, total int64)
+	var status *statusMessage
+	if *showStatus {
+		status = startStatus(opts)
+		progressFuncs = append(progressFuncs, status.update)
+	}
+	switch *progressFormat {
+	case "":
+	case "json":
+		reporter, err := newProgressReporter(*progressFD, opts.JobID, filePath, *progressInterval)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid -progress-fd: %v\n", err)
+			os.Exit(1)
+		}
+		progressFuncs = append(progressFuncs, reporter.update)
+	default:
+		fmt.Fprintf(os.Stderr, "Invalid -progress %q: only json is supported\n", *progressFormat)
+		os.Exit(1)
+	}
+	if len(progressFuncs) > 0 {
+		opts.Progress = func(sent, total int64) {
+			for _, f := range progressFuncs {
+				f(sent, total)
+			}
+		}
+	}
+
+	result, err := uploadFile(opts)
+	if status != nil {
+		status.finish()
+	}
+	flushTraces()
+
+	messageID := 0
+	if err == nil {
+		messageID = result.MessageID
+		opts.ChatID = result.ChatID
+	}
+	if err == nil && opts.PublishChatID != 0 {
+		if messageID, err = publishStaged(opts, result); err == nil {
+			logf("Published staged message %d to chat %d\n", result.MessageID, opts.PublishChatID)
+		}
+		opts.ChatID, opts.ReplyToMessageID, opts.ThreadID = opts.PublishChatID, opts.PublishReplyTo, opts.PublishThreadID
+	}
+
+	if err == nil && *reaction != "" {
+		if reactErr := setReaction(botToken, opts.ChatID, messageID, *reaction); reactErr != nil {
+			logf("Warning: failed to set reaction: %v\n", reactErr)
+		}
+	}
+
+	if *postHook != "" {
+		if hookErr := runHook(*postHook, opts, messageID, err); hookErr != nil {
+			logf("Warning: %v\n", hookErr)
+		}
+	}
+
+	// -json streams one line per finished chat as soon as it is known
+	emit := func(record resultRecord) {
+		line, _ := json.Marshal(record)
+		fmt.Println(string(line))
+	}
+
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error uploading file: %v\n", err)
+		errorf("Error uploading file: %v\n", err)
+		if *notifyChat != "" {
+			if notifyErr := notifyFailure(botToken, *notifyChat, opts, err); notifyErr != nil {
+				logf("Warning: failed to send failure notification: %v\n", notifyErr)
+			}
+		}
+		if *jsonOutput {
+			emit(resultRecord{JobID: opts.JobID, ChatID: chatID, File: filePath, Error: err.Error()})
+		}
 		os.Exit(1)
 	}
 
-	fmt.Println(messageID)
+	if *jsonOutput {
+		record := resultRecord{JobID: opts.JobID, ChatID: opts.ChatID, File: filePath, MessageID: messageID,
+			FileID: result.FileID, FileUniqueID: result.FileUniqueID, FileSize: result.StoredSize,
+			Transcoded: result.Transcoded}
+		// A staged upload's message is the one in the staging chat
+		if stagingChat == 0 {
+			record.Date = result.Date
+			if *jsonMessage {
+				record.Message = result.Message
+			}
+		}
+		emit(record)
+	} else if len(alsoTo) == 0 {
+		fmt.Println(messageID)
+		return
+	}
+
+	var done func(int64, fanOutResult)
+	if *jsonOutput {
+		done = func(chatID int64, r fanOutResult) {
+			emit(resultRecord{JobID: opts.JobID, ChatID: chatID, File: filePath, MessageID: r.MessageID, Error: r.Error})
+		}
+	}
+
+	// Without -json, report every destination at the end as a JSON map
+	// keyed by chat ID
+	results := fanOut(opts, result, alsoTo, *fanOutConcurrency, done)
+	if !*jsonOutput {
+		results[chatID] = fanOutResult{MessageID: messageID}
+		output, _ := json.Marshal(results)
+		fmt.Println(string(output))
+	}
+	for _, r := range results {
+		if r.Error != "" {
+			os.Exit(1)
+		}
+	}
 }
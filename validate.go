@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// validateConfig checks the config file, the topic cache and the state
+// directory, returning every problem found rather than stopping at the
+// first, so a misconfiguration shows up before a batch rather than in it.
+func validateConfig() []string {
+	var problems []string
+	problemf := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	cfg := &config{}
+	if data, err := os.ReadFile(configFile()); err == nil {
+		// Unknown keys are usually typos that would otherwise be ignored
+		// without a word
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		if strictErr := decoder.Decode(cfg); strictErr != nil {
+			cfg = &config{}
+			if err := json.Unmarshal(data, cfg); err != nil {
+				problemf("config %s does not parse: %v", configFile(), err)
+			} else {
+				problemf("config %s: %v", configFile(), strictErr)
+			}
+		}
+		if info, err := os.Stat(configFile()); err == nil && runtime.GOOS != "windows" &&
+			len(cfg.Headers) > 0 && info.Mode().Perm()&0077 != 0 {
+			problemf("config %s holds headers but is readable by other users (mode %v)", configFile(), info.Mode().Perm())
+		}
+	} else if !os.IsNotExist(err) {
+		problemf("config %s is unreadable: %v", configFile(), err)
+	}
+
+	for name, chatID := range cfg.Aliases {
+		if _, err := strconv.ParseInt(name, 10, 64); err == nil || name == "self" {
+			problemf("alias %q shadows a chat ID and can never be used", name)
+		}
+		if chatID == 0 {
+			problemf("alias %q points at chat 0", name)
+		}
+	}
+
+	for name := range cfg.Headers {
+		if !validHeaderName(name) {
+			problemf("header %q is not a valid header name", name)
+			continue
+		}
+		// These are set per request; overriding them breaks uploads
+		switch strings.ToLower(name) {
+		case "content-type", "content-length", "host":
+			problemf("header %q must not be set for every request", name)
+		}
+	}
+
+	for id, limits := range cfg.Limits {
+		if _, err := strconv.ParseInt(id, 10, 64); err != nil {
+			problemf("limits key %q is not a bot ID (the part of the token before the colon)", id)
+		}
+		if limits.MaxConcurrent < 0 || limits.RequestsPerSecond < 0 {
+			problemf("limits for bot %s must not be negative", id)
+		}
+	}
+
+	for key, defaults := range cfg.Chats {
+		if _, err := resolveChatID(cfg, key); err != nil || key == "self" {
+			problemf("chat defaults for %q: not a chat ID or alias", key)
+		}
+		switch defaults.ParseMode {
+		case "", "HTML", "Markdown", "MarkdownV2":
+		default:
+			problemf("chat defaults for %q: unknown parse_mode %q", key, defaults.ParseMode)
+		}
+		if defaults.DelaySeconds < 0 {
+			problemf("chat defaults for %q: delay_seconds must not be negative", key)
+		}
+		if defaults.Caption != "" {
+			if _, err := renderCaption(defaults.Caption, uploadOptions{FilePath: "example.flac"}); err != nil {
+				problemf("chat defaults for %q: invalid caption: %v", key, err)
+			}
+		}
+	}
+
+	if cache, err := loadTopicCache(); err != nil {
+		problemf("%v", err)
+	} else {
+		for chat, topics := range cache {
+			if _, err := strconv.ParseInt(chat, 10, 64); err != nil {
+				problemf("topic cache has an entry for %q, which is not a chat ID", chat)
+			}
+			for name, threadID := range topics {
+				if threadID <= 0 {
+					problemf("topic %q in chat %s has thread ID %d", name, chat, threadID)
+				}
+			}
+		}
+	}
+
+	// The state directory is created on first use, so only an existing one
+	// can be checked
+	if info, err := os.Stat(stateDir()); err == nil {
+		if !info.IsDir() {
+			problemf("state directory %s is not a directory", stateDir())
+		} else if probe, err := os.CreateTemp(stateDir(), ".preflight-*"); err != nil {
+			problemf("state directory %s is not writable: %v", stateDir(), err)
+		} else {
+			probe.Close()
+			os.Remove(probe.Name())
+		}
+	}
+	for _, path := range []string{historyFile(), deadLetterFile(), breakerStateFile(), topicCacheFile(), lastUploadTimestampFile()} {
+		file, err := os.OpenFile(path, os.O_RDWR, 0)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				problemf("%s cannot be updated: %v", path, err)
+			}
+			continue
+		}
+		file.Close()
+	}
+
+	return problems
+}
+
+// validHeaderName reports whether name is a valid HTTP header field name.
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if c <= ' ' || c >= 0x7f || strings.ContainsRune("\"(),/:;<=>?@[\\]{}", c) {
+			return false
+		}
+	}
+	return true
+}
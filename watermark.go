@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// watermarkPositions are the places -watermark-position accepts.
+var watermarkPositions = []string{"bottom-right", "bottom-left", "top-right", "top-left", "center"}
+
+// watermarkStep writes a watermarked copy of the image at input to output,
+// which keeps the input's extension.
+type watermarkStep func(input, output string) error
+
+// watermarkFor returns the step that brands images for opts: the
+// -watermark-command if set, otherwise the built-in logo overlay, or nil
+// if no watermark is configured.
+func watermarkFor(opts uploadOptions) watermarkStep {
+	switch {
+	case opts.WatermarkCommand != "":
+		return commandWatermark(opts.WatermarkCommand, opts.Watermark)
+	case opts.Watermark != "":
+		return overlayWatermark(opts.Watermark, opts.WatermarkPosition, opts.WatermarkOpacity)
+	}
+	return nil
+}
+
+// applyWatermark brands a photo sent as paid media and the thumbnail of a
+// video, returning opts pointing at the watermarked copies. The originals
+// are left alone. The caller removes the returned directory when done.
+func applyWatermark(opts uploadOptions) (uploadOptions, string, error) {
+	step := watermarkFor(opts)
+	kind := paidMediaKind(opts.FilePath)
+	photo := opts.PaidStars > 0 && kind == "photo"
+	thumbnail := opts.ThumbnailPath != "" && (sendsAsVideo(opts) || opts.PaidStars > 0 && kind == "video")
+	if step == nil || !photo && !thumbnail {
+		return opts, "", nil
+	}
+
+	dir, err := makeWorkDir("watermark-")
+	if err != nil {
+		return opts, "", err
+	}
+	if photo {
+		output := filepath.Join(dir, filepath.Base(opts.FilePath))
+		if err := step(opts.FilePath, output); err != nil {
+			os.RemoveAll(dir)
+			return opts, "", fmt.Errorf("failed to watermark %s: %v", opts.FilePath, err)
+		}
+		opts.FilePath = output
+	}
+	if thumbnail {
+		output := filepath.Join(dir, "thumbnail-"+filepath.Base(opts.ThumbnailPath))
+		if err := step(opts.ThumbnailPath, output); err != nil {
+			os.RemoveAll(dir)
+			return opts, "", fmt.Errorf("failed to watermark thumbnail %s: %v", opts.ThumbnailPath, err)
+		}
+		opts.ThumbnailPath = output
+	}
+	return opts, dir, nil
+}
+
+// commandWatermark runs a user-supplied step, e.g. ImageMagick drawing a
+// text mark. The command reads $UPLOADER_FILE and writes $UPLOADER_OUTPUT;
+// the -watermark image, if any, is in $UPLOADER_WATERMARK.
+func commandWatermark(command, logo string) watermarkStep {
+	return func(input, output string) error {
+		cmd := shellCommand(command)
+		cmd.Env = append(os.Environ(), "UPLOADER_FILE="+input, "UPLOADER_OUTPUT="+output, "UPLOADER_WATERMARK="+logo)
+		cmd.Stdout = os.Stderr
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("watermark command %q failed: %v", command, err)
+		}
+		if _, err := os.Stat(output); err != nil {
+			return fmt.Errorf("watermark command %q did not write $UPLOADER_OUTPUT", command)
+		}
+		return nil
+	}
+}
+
+// overlayWatermark draws the logo image in a corner of the picture, scaled
+// down to at most a fifth of its width, at the given opacity.
+func overlayWatermark(logoPath, position string, opacity float64) watermarkStep {
+	return func(input, output string) error {
+		logo, err := decodeImage(logoPath)
+		if err != nil {
+			return err
+		}
+		src, err := decodeImage(input)
+		if err != nil {
+			return err
+		}
+
+		bounds := src.Bounds()
+		img := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+		draw.Draw(img, img.Bounds(), src, bounds.Min, draw.Src)
+
+		if maxWidth := img.Bounds().Dx() / 5; logo.Bounds().Dx() > maxWidth && maxWidth > 0 {
+			logo = scaleImage(logo, maxWidth, logo.Bounds().Dy()*maxWidth/logo.Bounds().Dx())
+		}
+		size := logo.Bounds().Size()
+		margin := img.Bounds().Dx() / 40
+		var at image.Point
+		switch position {
+		case "top-left":
+			at = image.Pt(margin, margin)
+		case "top-right":
+			at = image.Pt(img.Bounds().Dx()-size.X-margin, margin)
+		case "bottom-left":
+			at = image.Pt(margin, img.Bounds().Dy()-size.Y-margin)
+		case "center":
+			at = image.Pt((img.Bounds().Dx()-size.X)/2, (img.Bounds().Dy()-size.Y)/2)
+		default:
+			at = image.Pt(img.Bounds().Dx()-size.X-margin, img.Bounds().Dy()-size.Y-margin)
+		}
+		mask := &image.Uniform{color.Alpha{uint8(opacity * 0xff)}}
+		draw.DrawMask(img, image.Rectangle{at, at.Add(size)}, logo, logo.Bounds().Min, mask, image.Point{}, draw.Over)
+
+		file, err := os.Create(output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		switch strings.ToLower(filepath.Ext(output)) {
+		case ".png":
+			err = png.Encode(file, img)
+		default:
+			err = jpeg.Encode(file, img, &jpeg.Options{Quality: 90})
+		}
+		if err != nil {
+			return err
+		}
+		return file.Close()
+	}
+}
+
+// decodeImage reads a JPEG or PNG file.
+func decodeImage(path string) (image.Image, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	img, _, err := image.Decode(file)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode %s (only JPEG and PNG are supported without -watermark-command): %v", path, err)
+	}
+	return img, nil
+}
+
+// scaleImage resizes img to width x height by sampling the nearest pixel,
+// which is plenty for a logo shrunk to fit.
+func scaleImage(img image.Image, width, height int) image.Image {
+	if height < 1 {
+		height = 1
+	}
+	bounds := img.Bounds()
+	scaled := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			scaled.Set(x, y, img.At(bounds.Min.X+x*bounds.Dx()/width, bounds.Min.Y+y*bounds.Dy()/height))
+		}
+	}
+	return scaled
+}